@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var adminAuthKey = flag.String("adminAuthKey", "", "Auth key for /api/v1/admin/* endpoints. It must be passed either via authKey query arg "+
+	"or via `Authorization: Bearer <authKey>` request header. Admin endpoints are disabled if -adminAuthKey isn't set")
+
+// registerAdminHandlers registers admin API handlers for js at mux.
+func registerAdminHandlers(mux *http.ServeMux, js *jobs) {
+	mux.HandleFunc("POST /api/v1/admin/jobs/{job}", adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		jobName := r.PathValue("job")
+		po, err := parseJobOverrides(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if js.getTarget(jobName) == nil {
+			http.Error(w, fmt.Sprintf("unknown job %q", jobName), http.StatusNotFound)
+			return
+		}
+		if err := js.setOverrides(jobName, po); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("job %q has been updated via admin API from %s", jobName, r.RemoteAddr)
+		writeJobStatus(w, js, jobName)
+	}))
+	mux.HandleFunc("DELETE /api/v1/admin/jobs/{job}", adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		jobName := r.PathValue("job")
+		if js.getTarget(jobName) == nil {
+			http.Error(w, fmt.Sprintf("unknown job %q", jobName), http.StatusNotFound)
+			return
+		}
+		js.resetOverrides(jobName)
+		log.Printf("admin API overrides for job %q have been reset from %s", jobName, r.RemoteAddr)
+		writeJobStatus(w, js, jobName)
+	}))
+	mux.HandleFunc("POST /api/v1/admin/jobs/{job}/churn", adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		jobName := r.PathValue("job")
+		percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse `percent` arg: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := validatePercent("percent", percent); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := js.getTarget(jobName)
+		if t == nil {
+			http.Error(w, fmt.Sprintf("unknown job %q", jobName), http.StatusNotFound)
+			return
+		}
+		cr := t.churnBurst(percent)
+		log.Printf("churn burst for %v%% of targets at job %q has been triggered via admin API from %s", percent, jobName, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"relabeled":%d,"added":%d,"removed":%d}`, len(cr.relabeled), len(cr.added), len(cr.removed))
+	}))
+}
+
+// adminHandler wraps h with -adminAuthKey check.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(*adminAuthKey) == 0 {
+			http.Error(w, "admin API is disabled; set -adminAuthKey for enabling it", http.StatusForbidden)
+			return
+		}
+		key := r.URL.Query().Get("authKey")
+		if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(*adminAuthKey)) != 1 {
+			metrics.getOrCreateCounter(`vmagent_config_updater_admin_auth_errors_total`).inc()
+			http.Error(w, "invalid auth key", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// parseJobOverrides parses job overrides from query args or form values at r.
+func parseJobOverrides(r *http.Request) (*jobOverrides, error) {
+	var po jobOverrides
+	if s := r.FormValue("targets_count"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("`targets_count` must be positive integer; got %q", s)
+		}
+		po.TargetsCount = n
+	}
+	var err error
+	if po.ScrapeInterval, err = parsePositiveDuration(r, "scrape_interval"); err != nil {
+		return nil, err
+	}
+	if po.UpdateInterval, err = parsePositiveDuration(r, "update_interval"); err != nil {
+		return nil, err
+	}
+	if s := r.FormValue("update_percent"); len(s) > 0 {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `update_percent`: %w", err)
+		}
+		po.UpdatePercent = &v
+	}
+	return &po, nil
+}
+
+func parsePositiveDuration(r *http.Request, name string) (time.Duration, error) {
+	s := r.FormValue(name)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("`%s` must be positive duration; got %q", name, s)
+	}
+	return d, nil
+}
+
+// merge sets options from src, which are overridden there, at po.
+func (po *jobOverrides) merge(src *jobOverrides) {
+	if src.TargetsCount > 0 {
+		po.TargetsCount = src.TargetsCount
+	}
+	if src.ScrapeInterval > 0 {
+		po.ScrapeInterval = src.ScrapeInterval
+	}
+	if src.UpdateInterval > 0 {
+		po.UpdateInterval = src.UpdateInterval
+	}
+	if src.UpdatePercent != nil {
+		po.UpdatePercent = src.UpdatePercent
+	}
+	if src.Churn != nil {
+		po.Churn = src.Churn
+	}
+}
+
+func writeJobStatus(w http.ResponseWriter, js *jobs, jobName string) {
+	t := js.getTarget(jobName)
+	if t == nil {
+		http.Error(w, fmt.Sprintf("unknown job %q", jobName), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.status()); err != nil {
+		log.Printf("cannot send status for job %q: %s", jobName, err)
+	}
+}
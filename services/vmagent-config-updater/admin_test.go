@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 10
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+
+	f := func(authKey, path, authHeader string, wantCode int) {
+		t.Helper()
+		defer func(v string) {
+			*adminAuthKey = v
+		}(*adminAuthKey)
+		*adminAuthKey = authKey
+		header := http.Header{}
+		if len(authHeader) > 0 {
+			header.Set("Authorization", authHeader)
+		}
+		resp := serveAdminRequest(h, http.MethodPost, path, header)
+		if resp.Code != wantCode {
+			t.Fatalf("unexpected status code for %s with Authorization=%q; got %d; want %d; response: %s", path, authHeader, resp.Code, wantCode, resp.Body)
+		}
+	}
+
+	const path = "/api/v1/admin/jobs/job/churn?percent=0"
+
+	// admin API is disabled
+	f("", path, "", http.StatusForbidden)
+	f("", path+"&authKey=", "", http.StatusForbidden)
+
+	// missing auth key
+	f("secret", path, "", http.StatusUnauthorized)
+
+	// auth key via query arg
+	f("secret", path+"&authKey=secret", "", http.StatusOK)
+	f("secret", path+"&authKey=wrong", "", http.StatusUnauthorized)
+
+	// auth key via Authorization header
+	f("secret", path, "Bearer secret", http.StatusOK)
+	f("secret", path, "Bearer wrong", http.StatusUnauthorized)
+
+	// Authorization header takes precedence over query arg
+	f("secret", path+"&authKey=secret", "Bearer wrong", http.StatusUnauthorized)
+	f("secret", path+"&authKey=wrong", "Bearer secret", http.StatusOK)
+}
+
+func TestAdminOverrides(t *testing.T) {
+	defer func(v string) {
+		*adminAuthKey = v
+	}(*adminAuthKey)
+	*adminAuthKey = "secret"
+
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 10
+  update_percent: 10
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+
+	f := func(method, path string, wantCode int) {
+		t.Helper()
+		resp := serveAdminRequest(h, method, path+"&authKey=secret", nil)
+		if resp.Code != wantCode {
+			t.Fatalf("unexpected status code for %s %s; got %d; want %d; response: %s", method, path, resp.Code, wantCode, resp.Body)
+		}
+	}
+	checkJob := func(wantTargetsCount int, wantUpdatePercent float64) {
+		t.Helper()
+		resp := serveRequest(h, "/api/v1/jobs", nil)
+		var jss []*jobStatus
+		if err := json.Unmarshal(resp.Body.Bytes(), &jss); err != nil {
+			t.Fatalf("cannot parse jobs status: %s", err)
+		}
+		if len(jss) != 1 {
+			t.Fatalf("unexpected number of jobs; got %d; want 1", len(jss))
+		}
+		if jss[0].TargetsCount != wantTargetsCount {
+			t.Fatalf("unexpected targets_count; got %d; want %d", jss[0].TargetsCount, wantTargetsCount)
+		}
+		if jss[0].UpdatePercent != wantUpdatePercent {
+			t.Fatalf("unexpected update_percent; got %v; want %v", jss[0].UpdatePercent, wantUpdatePercent)
+		}
+		if n := len(getTargetInstances(t, h, "/api/v1/sd/job")); n != wantTargetsCount {
+			t.Fatalf("unexpected number of served targets; got %d; want %d", n, wantTargetsCount)
+		}
+	}
+
+	f(http.MethodPost, "/api/v1/admin/jobs/job?targets_count=20", http.StatusOK)
+	checkJob(20, 10)
+
+	// overrides are merged with the previous overrides
+	f(http.MethodPost, "/api/v1/admin/jobs/job?update_percent=50", http.StatusOK)
+	checkJob(20, 50)
+
+	// invalid overrides are rejected and don't change the job
+	f(http.MethodPost, "/api/v1/admin/jobs/job?targets_count=-1", http.StatusBadRequest)
+	f(http.MethodPost, "/api/v1/admin/jobs/job?update_percent=150", http.StatusBadRequest)
+	f(http.MethodPost, "/api/v1/admin/jobs/job?scrape_interval=foo", http.StatusBadRequest)
+	f(http.MethodPost, "/api/v1/admin/jobs/missing?targets_count=20", http.StatusNotFound)
+	checkJob(20, 50)
+
+	// overrides are preserved across config reloads
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 5
+  update_percent: 1
+`)
+	checkJob(20, 50)
+
+	// reset returns the job to the config
+	f(http.MethodDelete, "/api/v1/admin/jobs/job?", http.StatusOK)
+	checkJob(5, 1)
+	f(http.MethodDelete, "/api/v1/admin/jobs/missing?", http.StatusNotFound)
+}
+
+func TestAdminChurnBurst(t *testing.T) {
+	defer func(v string) {
+		*adminAuthKey = v
+	}(*adminAuthKey)
+	*adminAuthKey = "secret"
+
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 10
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+
+	f := func(path string, wantCode int) {
+		t.Helper()
+		resp := serveAdminRequest(h, http.MethodPost, path+"&authKey=secret", nil)
+		if resp.Code != wantCode {
+			t.Fatalf("unexpected status code for %s; got %d; want %d; response: %s", path, resp.Code, wantCode, resp.Body)
+		}
+	}
+
+	f("/api/v1/admin/jobs/job/churn?", http.StatusBadRequest)
+	f("/api/v1/admin/jobs/job/churn?percent=foo", http.StatusBadRequest)
+	f("/api/v1/admin/jobs/job/churn?percent=-1", http.StatusBadRequest)
+	f("/api/v1/admin/jobs/job/churn?percent=101", http.StatusBadRequest)
+	f("/api/v1/admin/jobs/job/churn?percent=NaN", http.StatusBadRequest)
+	f("/api/v1/admin/jobs/missing/churn?percent=10", http.StatusNotFound)
+	if n := countTargetsWithRevision(t, h, "job", 1); n != 0 {
+		t.Fatalf("rejected churn bursts mustn't update targets; got %d updated targets", n)
+	}
+
+	f("/api/v1/admin/jobs/job/churn?percent=100", http.StatusOK)
+	if n := countTargetsWithRevision(t, h, "job", 1); n != 10 {
+		t.Fatalf("unexpected number of updated targets after churn burst; got %d; want 10", n)
+	}
+}
+
+func serveAdminRequest(h http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
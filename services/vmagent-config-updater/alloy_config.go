@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// marshalAlloyConfig returns Grafana Alloy config in River format with scrape configs for targets belonging to ss.
+//
+// Every job is converted to `prometheus.scrape` component. Relabeling rules are converted to `discovery.relabel`
+// and `prometheus.relabel` components, while remote write settings are converted to `prometheus.remote_write` component.
+//
+// Versions of targets are registered at rk.
+//
+// See https://grafana.com/docs/alloy/latest/reference/components/
+func marshalAlloyConfig(targets []*target, ss shardSpec, rk *renderKey) ([]byte, error) {
+	var aw alloyWriter
+	forwardTo := "[]"
+	if len(promRemoteWrite) > 0 {
+		forwardTo = "[prometheus.remote_write.default.receiver]"
+		aw.writeRemoteWrite(promRemoteWrite[0])
+	}
+	seen := make(map[string]struct{}, len(targets))
+	for i, t := range targets {
+		sc, err := t.prometheusConfig(ss, rk)
+		if err != nil {
+			return nil, err
+		}
+		label := alloyLabel(sc.JobName)
+		if _, ok := seen[label]; ok {
+			label = fmt.Sprintf("%s_%d", label, i)
+		}
+		seen[label] = struct{}{}
+		aw.writeScrapeConfig(sc, label, forwardTo)
+	}
+	return []byte(aw.sb.String()), nil
+}
+
+var alloyLabelRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// alloyLabel returns valid Alloy component label for the given job name.
+func alloyLabel(jobName string) string {
+	label := alloyLabelRe.ReplaceAllString(jobName, "_")
+	if len(label) == 0 || label[0] >= '0' && label[0] <= '9' {
+		label = "job_" + label
+	}
+	return label
+}
+
+// alloyWriter writes Alloy config in River format.
+type alloyWriter struct {
+	sb     strings.Builder
+	indent int
+}
+
+func (aw *alloyWriter) line(format string, args ...any) {
+	aw.sb.WriteString(strings.Repeat("  ", aw.indent))
+	fmt.Fprintf(&aw.sb, format, args...)
+	aw.sb.WriteByte('\n')
+}
+
+func (aw *alloyWriter) openBlock(format string, args ...any) {
+	aw.line(format+" {", args...)
+	aw.indent++
+}
+
+func (aw *alloyWriter) closeBlock() {
+	aw.indent--
+	aw.line("}")
+}
+
+func (aw *alloyWriter) attr(name, value string) {
+	aw.line("%s = %s", name, value)
+}
+
+func (aw *alloyWriter) stringAttr(name, value string) {
+	if len(value) > 0 {
+		aw.attr(name, strconv.Quote(value))
+	}
+}
+
+func (aw *alloyWriter) durationAttr(name string, d time.Duration) {
+	if d > 0 {
+		aw.attr(name, strconv.Quote(d.String()))
+	}
+}
+
+func (aw *alloyWriter) intAttr(name string, n int) {
+	if n > 0 {
+		aw.attr(name, strconv.Itoa(n))
+	}
+}
+
+func (aw *alloyWriter) writeRemoteWrite(rwc *remoteWriteConfig) {
+	aw.openBlock(`prometheus.remote_write "default"`)
+	if promGlobal != nil && len(promGlobal.ExternalLabels) > 0 {
+		aw.attr("external_labels", alloyObject(promGlobal.ExternalLabels))
+	}
+	aw.openBlock("endpoint")
+	aw.stringAttr("url", rwc.URL)
+	aw.stringAttr("name", rwc.Name)
+	aw.durationAttr("remote_timeout", rwc.RemoteTimeout)
+	if len(rwc.Headers) > 0 {
+		aw.attr("headers", alloyObject(rwc.Headers))
+	}
+	if ba := rwc.BasicAuth; ba != nil {
+		aw.openBlock("basic_auth")
+		aw.stringAttr("username", ba.Username)
+		aw.stringAttr("password_file", ba.PasswordFile)
+		aw.closeBlock()
+	}
+	if a := rwc.Authorization; a != nil {
+		aw.stringAttr("bearer_token_file", a.CredentialsFile)
+	}
+	if tc := rwc.TLSConfig; tc != nil {
+		aw.writeTLSConfig(tc)
+	}
+	if qc := rwc.QueueConfig; qc != nil {
+		aw.openBlock("queue_config")
+		aw.intAttr("capacity", qc.Capacity)
+		aw.intAttr("min_shards", qc.MinShards)
+		aw.intAttr("max_shards", qc.MaxShards)
+		aw.intAttr("max_samples_per_send", qc.MaxSamplesPerSend)
+		aw.durationAttr("batch_send_deadline", qc.BatchSendDeadline)
+		aw.durationAttr("min_backoff", qc.MinBackoff)
+		aw.durationAttr("max_backoff", qc.MaxBackoff)
+		aw.closeBlock()
+	}
+	aw.closeBlock()
+	aw.closeBlock()
+	aw.line("")
+}
+
+func (aw *alloyWriter) writeScrapeConfig(sc *scrapeConfig, label, forwardTo string) {
+	targets := "discovery.relabel." + label + ".output"
+	if len(sc.RelabelConfigs) > 0 {
+		aw.openBlock(`discovery.relabel %q`, label)
+		aw.writeTargets(sc)
+		aw.writeRelabelRules(sc.RelabelConfigs)
+		aw.closeBlock()
+		aw.line("")
+	} else {
+		targets = ""
+	}
+	if len(sc.MetricRelabelConfigs) > 0 {
+		aw.openBlock(`prometheus.relabel %q`, label)
+		aw.attr("forward_to", forwardTo)
+		aw.writeRelabelRules(sc.MetricRelabelConfigs)
+		aw.closeBlock()
+		aw.line("")
+		forwardTo = "[prometheus.relabel." + label + ".receiver]"
+	}
+
+	aw.openBlock(`prometheus.scrape %q`, label)
+	if len(targets) > 0 {
+		aw.attr("targets", targets)
+	} else {
+		aw.writeTargets(sc)
+	}
+	aw.attr("forward_to", forwardTo)
+	aw.stringAttr("job_name", sc.JobName)
+	aw.durationAttr("scrape_interval", sc.ScrapeInterval)
+	aw.durationAttr("scrape_timeout", sc.ScrapeTimeout)
+	aw.stringAttr("metrics_path", sc.MetricsPath)
+	aw.stringAttr("scheme", sc.Scheme)
+	if len(sc.Params) > 0 {
+		names := sortedKeys(sc.Params)
+		items := make([]string, len(names))
+		for i, name := range names {
+			values := make([]string, len(sc.Params[name]))
+			for j, v := range sc.Params[name] {
+				values[j] = strconv.Quote(v)
+			}
+			items[i] = fmt.Sprintf("%s = [%s]", strconv.Quote(name), strings.Join(values, ", "))
+		}
+		aw.attr("params", "{"+strings.Join(items, ", ")+"}")
+	}
+	if sc.HonorLabels {
+		aw.attr("honor_labels", "true")
+	}
+	if sc.HonorTimestamps != nil {
+		aw.attr("honor_timestamps", strconv.FormatBool(*sc.HonorTimestamps))
+	}
+	aw.intAttr("sample_limit", sc.SampleLimit)
+	aw.intAttr("label_limit", sc.LabelLimit)
+	aw.stringAttr("body_size_limit", sc.BodySizeLimit)
+	if hc := sc.HTTPConfig; hc != nil {
+		aw.stringAttr("bearer_token_file", hc.BearerTokenFile)
+		aw.stringAttr("proxy_url", hc.ProxyURL)
+		if ba := hc.BasicAuth; ba != nil {
+			aw.openBlock("basic_auth")
+			aw.stringAttr("username", ba.Username)
+			aw.stringAttr("password_file", ba.PasswordFile)
+			aw.closeBlock()
+		}
+		if a := hc.Authorization; a != nil {
+			aw.openBlock("authorization")
+			aw.stringAttr("type", a.Type)
+			aw.stringAttr("credentials_file", a.CredentialsFile)
+			aw.closeBlock()
+		}
+		if o := hc.OAuth2; o != nil {
+			aw.openBlock("oauth2")
+			aw.stringAttr("client_id", o.ClientID)
+			aw.stringAttr("client_secret_file", o.ClientSecretFile)
+			aw.stringAttr("token_url", o.TokenURL)
+			if len(o.Scopes) > 0 {
+				aw.attr("scopes", alloyList(o.Scopes))
+			}
+			aw.closeBlock()
+		}
+		if tc := hc.TLSConfig; tc != nil {
+			aw.writeTLSConfig(tc)
+		}
+	}
+	aw.closeBlock()
+	aw.line("")
+}
+
+func (aw *alloyWriter) writeTargets(sc *scrapeConfig) {
+	aw.line("targets = [")
+	aw.indent++
+	for _, s := range sc.StaticConfigs {
+		for _, addr := range s.Targets {
+			labels := make(map[string]string, len(s.Labels)+1)
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			labels["__address__"] = addr
+			aw.line("%s,", alloyObject(labels))
+		}
+	}
+	aw.indent--
+	aw.line("]")
+}
+
+func (aw *alloyWriter) writeRelabelRules(rcs []*relabelConfig) {
+	for _, rc := range rcs {
+		aw.openBlock("rule")
+		if len(rc.SourceLabels) > 0 {
+			aw.attr("source_labels", alloyList(rc.SourceLabels))
+		}
+		if rc.Separator != nil {
+			aw.attr("separator", strconv.Quote(*rc.Separator))
+		}
+		if len(rc.Regex) > 0 {
+			aw.stringAttr("regex", rc.Regex[0])
+		}
+		if rc.Modulus > 0 {
+			aw.attr("modulus", strconv.FormatUint(rc.Modulus, 10))
+		}
+		aw.stringAttr("target_label", rc.TargetLabel)
+		if rc.Replacement != nil {
+			aw.attr("replacement", strconv.Quote(*rc.Replacement))
+		}
+		aw.stringAttr("action", rc.Action)
+		aw.closeBlock()
+	}
+}
+
+func (aw *alloyWriter) writeTLSConfig(tc *tlsConfig) {
+	aw.openBlock("tls_config")
+	aw.stringAttr("ca_file", tc.CAFile)
+	aw.stringAttr("cert_file", tc.CertFile)
+	aw.stringAttr("key_file", tc.KeyFile)
+	aw.stringAttr("server_name", tc.ServerName)
+	if tc.InsecureSkipVerify {
+		aw.attr("insecure_skip_verify", "true")
+	}
+	aw.closeBlock()
+}
+
+// alloyObject returns Alloy object with sorted keys for m.
+func alloyObject(m map[string]string) string {
+	keys := sortedKeys(m)
+	items := make([]string, len(keys))
+	for i, k := range keys {
+		items[i] = fmt.Sprintf("%s = %s", strconv.Quote(k), strconv.Quote(m[k]))
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+// alloyList returns Alloy list of strings for a.
+func alloyList(a []string) string {
+	items := make([]string, len(a))
+	for i, s := range a {
+		items[i] = strconv.Quote(s)
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gzipResponses = flag.Bool("gzipResponses", false, "Whether to compress responses with gzip for clients sending `Accept-Encoding: gzip` request header")
+
+// maxCachedResponses limits the number of cached responses, since clients may request arbitrary shards.
+//
+// The least recently used responses are evicted when the limit is reached.
+const maxCachedResponses = 1024
+
+// cachedResponse holds response bytes rendered for a particular key.
+type cachedResponse struct {
+	key          string
+	data         []byte
+	etag         string
+	gzipData     []byte
+	gzipETag     string
+	lastModified time.Time
+}
+
+// cacheEntry holds the most recently rendered response with a particular name.
+//
+// mu is held while rendering the response, so concurrent requests for the same response wait for a single render call,
+// while requests for other responses aren't blocked.
+type cacheEntry struct {
+	name string
+
+	mu sync.Mutex
+	cr *cachedResponse
+}
+
+// responseCache caches rendered responses, so they aren't re-rendered until the underlying targets change.
+type responseCache struct {
+	mu sync.Mutex
+	m  map[string]*list.Element
+
+	// lru contains *cacheEntry items ordered from the most recently used to the least recently used.
+	lru list.List
+}
+
+var responses = &responseCache{
+	m: make(map[string]*list.Element),
+}
+
+// renderKey collects cache key and the last modification time for targets used in the rendered response.
+type renderKey struct {
+	key          strings.Builder
+	lastModified time.Time
+}
+
+// add registers the given version and modification time for t at rk.
+func (rk *renderKey) add(t *target, version uint64, modified time.Time) {
+	if rk == nil {
+		return
+	}
+	fmt.Fprintf(&rk.key, "%s:%p:%d,", t.jobName, t, version)
+	if modified.After(rk.lastModified) {
+		rk.lastModified = modified
+	}
+}
+
+// addLocked registers the current version of t at rk.
+//
+// It must be called under t.mu while reading targets for the rendered response, so the key matches the rendered data.
+func (rk *renderKey) addLocked(t *target) {
+	rk.add(t, t.version, t.lastModified)
+}
+
+// get returns cached response with the given name if it was rendered for the given key.
+//
+// Otherwise the response is rendered via render() and is stored in the cache under the key collected by render() at rk.
+// Concurrent requests for the same response wait for a single render() call.
+// Errors returned from render() aren't cached.
+func (rc *responseCache) get(name, key string, render func(rk *renderKey) ([]byte, error)) (*cachedResponse, error) {
+	e := rc.getEntry(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cr := e.cr; cr != nil && cr.key == key {
+		metrics.getOrCreateCounter(`vmagent_config_updater_response_cache_hits_total{name=` + quoteLabelValue(cacheMetricName(name)) + `}`).inc()
+		return cr, nil
+	}
+	var rk renderKey
+	data, err := render(&rk)
+	if err != nil {
+		return nil, err
+	}
+	cr := &cachedResponse{
+		key:          rk.key.String(),
+		data:         data,
+		etag:         newETag(data),
+		lastModified: rk.lastModified,
+	}
+	if *gzipResponses {
+		cr.gzipData = compressGzip(data)
+		cr.gzipETag = newETag(cr.gzipData)
+	}
+	e.cr = cr
+	return cr, nil
+}
+
+// getEntry returns cache entry for the given name and marks it as the most recently used.
+func (rc *responseCache) getEntry(name string) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el := rc.m[name]; el != nil {
+		rc.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry)
+	}
+	e := &cacheEntry{
+		name: name,
+	}
+	rc.m[name] = rc.lru.PushFront(e)
+	if rc.lru.Len() > maxCachedResponses {
+		el := rc.lru.Back()
+		rc.lru.Remove(el)
+		delete(rc.m, el.Value.(*cacheEntry).name)
+	}
+	return e
+}
+
+// cacheMetricName returns cache name without variable parts such as job names and shards.
+func cacheMetricName(name string) string {
+	if n := strings.IndexByte(name, '/'); n >= 0 {
+		return name[:n]
+	}
+	return name
+}
+
+// serve writes cr to w.
+//
+// It responds with `304 Not Modified` if the client already has the response with the same ETag.
+func (cr *cachedResponse) serve(w http.ResponseWriter, r *http.Request, contentType string) {
+	data, etag := cr.data, cr.etag
+	if cr.gzipData != nil {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			data, etag = cr.gzipData, cr.gzipETag
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", cr.lastModified, bytes.NewReader(data))
+}
+
+func newETag(data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+func compressGzip(data []byte) []byte {
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write(data); err != nil {
+		log.Fatalf("BUG: unexpected error when compressing response: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		log.Fatalf("BUG: unexpected error when compressing response: %s", err)
+	}
+	return bb.Bytes()
+}
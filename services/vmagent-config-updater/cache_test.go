@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, "jobs:\n- job_name: job\n  targets_count: 3\n  update_interval: 1h\n")
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+
+	for _, path := range []string{"/api/v1/config", "/api/v1/sd/job", "/api/v1/config?shard=1&shards=2"} {
+		t.Run(path, func(t *testing.T) {
+			resp := serveRequest(h, path, nil)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("unexpected status code; got %d; want %d", resp.Code, http.StatusOK)
+			}
+			etag := resp.Header().Get("ETag")
+			lastModified := resp.Header().Get("Last-Modified")
+			if etag == "" || lastModified == "" {
+				t.Fatalf("missing ETag or Last-Modified headers: %v", resp.Header())
+			}
+
+			resp = serveRequest(h, path, http.Header{"If-None-Match": {etag}})
+			if resp.Code != http.StatusNotModified {
+				t.Fatalf("unexpected status code for matching If-None-Match; got %d; want %d", resp.Code, http.StatusNotModified)
+			}
+			resp = serveRequest(h, path, http.Header{"If-Modified-Since": {lastModified}})
+			if resp.Code != http.StatusNotModified {
+				t.Fatalf("unexpected status code for If-Modified-Since=Last-Modified; got %d; want %d", resp.Code, http.StatusNotModified)
+			}
+			resp = serveRequest(h, path, http.Header{"If-Modified-Since": {time.Unix(0, 0).UTC().Format(http.TimeFormat)}})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("unexpected status code for outdated If-Modified-Since; got %d; want %d", resp.Code, http.StatusOK)
+			}
+		})
+	}
+
+	// Changing the targets must invalidate cached responses.
+	etagPrev := serveRequest(h, "/api/v1/sd/job", nil).Header().Get("ETag")
+	applyJobsConfig(t, js, "jobs:\n- job_name: job\n  targets_count: 5\n  update_interval: 1h\n")
+	resp := serveRequest(h, "/api/v1/sd/job", http.Header{"If-None-Match": {etagPrev}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code after targets change; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	if etag := resp.Header().Get("ETag"); etag == etagPrev {
+		t.Fatalf("ETag must change after targets change; got %s", etag)
+	}
+	if n := bytes.Count(resp.Body.Bytes(), []byte(`"targets"`)); n != 5 {
+		t.Fatalf("unexpected number of target groups after targets change; got %d; want 5", n)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	defer func(v bool) {
+		*gzipResponses = v
+	}(*gzipResponses)
+	*gzipResponses = true
+
+	js := &jobs{}
+	applyJobsConfig(t, js, "jobs:\n- job_name: gzip_job\n  targets_count: 10\n  update_interval: 1h\n")
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+
+	plain := serveRequest(h, "/api/v1/sd/gzip_job", nil)
+	if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("unexpected Content-Encoding for client without gzip support: %q", ce)
+	}
+	compressed := serveRequest(h, "/api/v1/sd/gzip_job", http.Header{"Accept-Encoding": {"gzip"}})
+	if ce := compressed.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("unexpected Content-Encoding; got %q; want %q", ce, "gzip")
+	}
+	if compressed.Header().Get("ETag") == plain.Header().Get("ETag") {
+		t.Fatalf("compressed and plain responses must have distinct ETag")
+	}
+	zr, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("cannot read gzipped response: %s", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot decompress response: %s", err)
+	}
+	if !bytes.Equal(data, plain.Body.Bytes()) {
+		t.Fatalf("decompressed response doesn't match plain response;\ngot\n%s\nwant\n%s", data, plain.Body.Bytes())
+	}
+	resp := serveRequest(h, "/api/v1/sd/gzip_job", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {compressed.Header().Get("ETag")}})
+	if resp.Code != http.StatusNotModified {
+		t.Fatalf("unexpected status code for matching If-None-Match; got %d; want %d", resp.Code, http.StatusNotModified)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rc := &responseCache{
+		m: make(map[string]*list.Element),
+	}
+	renders := make(map[string]int)
+	get := func(name string) {
+		rc.get(name, "", func(_ *renderKey) ([]byte, error) {
+			renders[name]++
+			return []byte(name), nil
+		})
+	}
+	get("hot")
+	get("cold")
+	for i := 0; i < maxCachedResponses; i++ {
+		get("hot")
+		get(fmt.Sprintf("other/%d", i))
+	}
+	get("hot")
+	get("cold")
+	if renders["hot"] != 1 {
+		t.Fatalf("recently used response mustn't be evicted; it was rendered %d times", renders["hot"])
+	}
+	if renders["cold"] != 2 {
+		t.Fatalf("least recently used response must be evicted; it was rendered %d times", renders["cold"])
+	}
+	if n := len(rc.m); n > maxCachedResponses {
+		t.Fatalf("the number of cached responses mustn't exceed %d; got %d", maxCachedResponses, n)
+	}
+}
+
+// applyJobsConfig applies jobs config from the given YAML to js.
+func applyJobsConfig(t *testing.T, js *jobs, config string) {
+	t.Helper()
+	jcs, err := parseJobConfigs([]byte(config))
+	if err != nil {
+		t.Fatalf("cannot parse jobs config: %s", err)
+	}
+	if err := js.update(jcs); err != nil {
+		t.Fatalf("cannot apply jobs config: %s", err)
+	}
+}
+
+// serveRequest serves GET request for the given path with the given headers via h.
+func serveRequest(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestResponseCacheDoesntCacheErrors(t *testing.T) {
+	rc := &responseCache{
+		m: make(map[string]*list.Element),
+	}
+	renders := 0
+	for i := 0; i < 2; i++ {
+		_, err := rc.get("broken", "", func(_ *renderKey) ([]byte, error) {
+			renders++
+			return nil, fmt.Errorf("cannot render")
+		})
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	if renders != 2 {
+		t.Fatalf("errors mustn't be cached; the response was rendered %d times; want 2", renders)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var (
+	churnStrategyName = newArrayFlag("churnStrategy", "uniform", "Strategy for selecting targets to update every -scrapeConfigUpdateInterval. "+
+		"Supported values: uniform, exact, exponential, storm, sine, cron. See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#churn-strategies")
+	churnMeanLifetime  = newArrayFlag("churnMeanLifetime", time.Duration(0), "Mean target lifetime for -churnStrategy=exponential")
+	churnStormInterval = newArrayFlag("churnStormInterval", time.Duration(0), "Interval between churn storms for -churnStrategy=storm")
+	churnStormPercent  = newArrayFlag("churnStormPercent", 0.0, "The percent of targets to update during churn storms for -churnStrategy=storm")
+	churnPeriod        = newArrayFlag("churnPeriod", time.Duration(0), "The period of churn rate changes for -churnStrategy=sine. For example, 24h for diurnal churn")
+	churnAmplitude     = newArrayFlag("churnAmplitude", 0.0, "The relative amplitude in the range [0..1] of churn rate changes for -churnStrategy=sine")
+	churnSchedule      = newArrayFlag("churnSchedule", "", "Cron schedule for churn events for -churnStrategy=cron, e.g. '0 * * * *'")
+	churnEventPercent  = newArrayFlag("churnEventPercent", 0.0, "The percent of targets to update during churn events for -churnStrategy=cron")
+	churnDistribution  = newArrayFlag("churnDistribution", "uniform", "Distribution of churn among targets. Supported values: uniform, zipf:<exponent>, normal:<stddev>. See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#skewed-distributions")
+	churnMode          = newArrayFlag("churnMode", "relabel", "How to update targets selected by -churnStrategy. Supported values: "+
+		"relabel - set new revision label at the selected targets; "+
+		"replace - replace the selected targets with new targets with unique labels; "+
+		"resize - remove the selected targets and add random number of new targets, so the number of targets stays within -churnMinTargets and -churnMaxTargets")
+	churnMinTargets = newArrayFlag("churnMinTargets", 0, "The minimum number of targets for -churnMode=resize")
+	churnMaxTargets = newArrayFlag("churnMaxTargets", 0, "The maximum number of targets for -churnMode=resize")
+)
+
+// churnConfig describes how targets are selected for update every `update_interval`.
+type churnConfig struct {
+	Strategy      string        `yaml:"strategy,omitempty"`
+	MeanLifetime  time.Duration `yaml:"mean_lifetime,omitempty"`
+	StormInterval time.Duration `yaml:"storm_interval,omitempty"`
+	StormPercent  float64       `yaml:"storm_percent,omitempty"`
+	Period        time.Duration `yaml:"period,omitempty"`
+	Amplitude     float64       `yaml:"amplitude,omitempty"`
+	Schedule      string        `yaml:"schedule,omitempty"`
+	EventPercent  float64       `yaml:"event_percent,omitempty"`
+	Mode          string        `yaml:"mode,omitempty"`
+	MinTargets    int           `yaml:"min_targets,omitempty"`
+	MaxTargets    int           `yaml:"max_targets,omitempty"`
+	Distribution  string        `yaml:"distribution,omitempty"`
+}
+
+// churnConfigFromFlags returns churnConfig from command-line flags for the job with the given idx.
+func churnConfigFromFlags(idx int) churnConfig {
+	return churnConfig{
+		Strategy:      churnStrategyName.getArg(idx),
+		MeanLifetime:  churnMeanLifetime.getArg(idx),
+		StormInterval: churnStormInterval.getArg(idx),
+		StormPercent:  churnStormPercent.getArg(idx),
+		Period:        churnPeriod.getArg(idx),
+		Amplitude:     churnAmplitude.getArg(idx),
+		Schedule:      churnSchedule.getArg(idx),
+		EventPercent:  churnEventPercent.getArg(idx),
+		Mode:          churnMode.getArg(idx),
+		MinTargets:    churnMinTargets.getArg(idx),
+		MaxTargets:    churnMaxTargets.getArg(idx),
+		Distribution:  churnDistribution.getArg(idx),
+	}
+}
+
+// churnContext contains the state needed for selecting targets to update at the next revision.
+type churnContext struct {
+	// seed is the job seed. See jobSeed.
+	seed uint64
+
+	// rev is the revision to set at the selected targets.
+	rev int
+
+	// tick is the number of regular updates every updateInterval including the current one.
+	tick int
+
+	// targetRevs contains revisions for the current labels of every target.
+	targetRevs []int
+
+	// weights contains the share of churn for every target according to churn distribution. It is nil for uniform distribution.
+	weights []float64
+
+	// updatePercent is the base share of targets to update in the range [0..1].
+	updatePercent float64
+
+	updateInterval time.Duration
+
+	// prevUpdate is the time of the previous update, while now is the time of the current update.
+	prevUpdate time.Time
+	now        time.Time
+}
+
+// churnStrategy selects targets to update at every revision.
+type churnStrategy interface {
+	// selectTargets returns indexes for targets to update at cc.rev.
+	selectTargets(cc *churnContext) []int
+}
+
+// newChurnStrategy returns churnStrategy for the given cfg.
+func newChurnStrategy(cfg *churnConfig) (churnStrategy, error) {
+	switch cfg.Strategy {
+	case "", "uniform":
+		return uniformChurn{}, nil
+	case "exact":
+		return exactChurn{}, nil
+	case "exponential":
+		if cfg.MeanLifetime <= 0 {
+			return nil, fmt.Errorf("`mean_lifetime` must be positive for `strategy: exponential`")
+		}
+		return &exponentialChurn{meanLifetime: cfg.MeanLifetime}, nil
+	case "storm":
+		if cfg.StormInterval <= 0 {
+			return nil, fmt.Errorf("`storm_interval` must be positive for `strategy: storm`")
+		}
+		if err := validatePercent("storm_percent", cfg.StormPercent); err != nil {
+			return nil, err
+		}
+		return &stormChurn{
+			interval: cfg.StormInterval,
+			percent:  cfg.StormPercent / 100,
+		}, nil
+	case "sine":
+		if cfg.Period <= 0 {
+			return nil, fmt.Errorf("`period` must be positive for `strategy: sine`")
+		}
+		if cfg.Amplitude < 0 || cfg.Amplitude > 1 {
+			return nil, fmt.Errorf("`amplitude` must be in the range [0..1] for `strategy: sine`; got %v", cfg.Amplitude)
+		}
+		return &sineChurn{
+			period:    cfg.Period,
+			amplitude: cfg.Amplitude,
+		}, nil
+	case "cron":
+		cs, err := parseCronSchedule(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `schedule` for `strategy: cron`: %w", err)
+		}
+		if err := validatePercent("event_percent", cfg.EventPercent); err != nil {
+			return nil, err
+		}
+		return &cronChurn{
+			schedule: cs,
+			percent:  cfg.EventPercent / 100,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported churn `strategy: %s`; supported values: uniform, exact, exponential, storm, sine, cron", cfg.Strategy)
+	}
+}
+
+// validateMode verifies cfg.Mode for the job with the given targetsCount.
+func (cfg *churnConfig) validateMode(targetsCount int) error {
+	switch cfg.Mode {
+	case "", "relabel", "replace":
+		return nil
+	case "resize":
+		if cfg.MinTargets < 0 || cfg.MinTargets > targetsCount {
+			return fmt.Errorf("`min_targets` must be in the range [0..%d] for `mode: resize`; got %d", targetsCount, cfg.MinTargets)
+		}
+		if cfg.MaxTargets < targetsCount {
+			return fmt.Errorf("`max_targets` cannot be smaller than `targets_count`=%d for `mode: resize`; got %d", targetsCount, cfg.MaxTargets)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported churn `mode: %s`; supported values: relabel, replace, resize", cfg.Mode)
+	}
+}
+
+func validatePercent(name string, v float64) error {
+	if !(v >= 0 && v <= 100) {
+		return fmt.Errorf("`%s` must be in the range [0..100]; got %v", name, v)
+	}
+	return nil
+}
+
+// probability returns the probability of selecting the target with index i if targets are selected with probability p on average.
+func (cc *churnContext) probability(i int, p float64) float64 {
+	if cc.weights == nil {
+		return p
+	}
+	return min(p*float64(len(cc.weights))*cc.weights[i], 1)
+}
+
+// selectUniform returns indexes for targets, where every target is selected with the given probability on average.
+//
+// The probability for every target is skewed according to cc.weights.
+func selectUniform(cc *churnContext, probability float64) []int {
+	var idxs []int
+	for i := range cc.targetRevs {
+		if randFloat64(cc.seed, cc.rev, i) < cc.probability(i, probability) {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// uniformChurn updates every target with `update_percent` probability.
+type uniformChurn struct{}
+
+func (uniformChurn) selectTargets(cc *churnContext) []int {
+	return selectUniform(cc, cc.updatePercent)
+}
+
+// exactChurn updates exactly `update_percent` of targets.
+type exactChurn struct{}
+
+func (exactChurn) selectTargets(cc *churnContext) []int {
+	n := int(math.Round(cc.updatePercent * float64(len(cc.targetRevs))))
+	if cc.weights != nil {
+		// Use weighted random sampling without replacement. See https://en.wikipedia.org/wiki/Reservoir_sampling#Algorithm_A-Res
+		idxs := make([]int, len(cc.targetRevs))
+		keys := make([]float64, len(cc.targetRevs))
+		for i := range idxs {
+			idxs[i] = i
+			keys[i] = math.Log(randFloat64(cc.seed, cc.rev, i)) / cc.weights[i]
+		}
+		sort.Slice(idxs, func(i, j int) bool {
+			return keys[idxs[i]] > keys[idxs[j]]
+		})
+		return idxs[:n]
+	}
+	r := rand.New(rand.NewSource(int64(splitmix64(cc.seed ^ uint64(cc.rev)))))
+	return r.Perm(len(cc.targetRevs))[:n]
+}
+
+// exponentialChurn updates targets when they reach their lifetime.
+//
+// Target lifetimes have exponential distribution with the given mean.
+type exponentialChurn struct {
+	meanLifetime time.Duration
+}
+
+func (ec *exponentialChurn) selectTargets(cc *churnContext) []int {
+	var idxs []int
+	for i, targetRev := range cc.targetRevs {
+		// The lifetime is a pure function of the revision when the target obtained its current labels.
+		u := randFloat64(cc.seed, targetRev, i)
+		lifetime := -math.Log(1-u) * float64(ec.meanLifetime)
+		if cc.weights != nil {
+			// Hot targets have proportionally shorter lifetimes, so they are updated more frequently.
+			lifetime /= float64(len(cc.weights)) * cc.weights[i]
+		}
+		age := float64(cc.rev-targetRev) * float64(cc.updateInterval)
+		if age >= lifetime {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// stormChurn updates `storm_percent` of targets every `storm_interval` and `update_percent` of targets otherwise.
+type stormChurn struct {
+	interval time.Duration
+	percent  float64
+}
+
+func (sc *stormChurn) selectTargets(cc *churnContext) []int {
+	every := max(1, int(sc.interval/cc.updateInterval))
+	if cc.tick%every == 0 {
+		return selectUniform(cc, sc.percent)
+	}
+	return selectUniform(cc, cc.updatePercent)
+}
+
+// sineChurn changes the share of updated targets around `update_percent` by sine with the given period and relative amplitude.
+//
+// The phase is calculated from the number of regular updates, so it doesn't depend on the wall clock.
+type sineChurn struct {
+	period    time.Duration
+	amplitude float64
+}
+
+func (sc *sineChurn) selectTargets(cc *churnContext) []int {
+	elapsed := float64(cc.tick) * float64(cc.updateInterval)
+	p := cc.updatePercent * (1 + sc.amplitude*math.Sin(2*math.Pi*elapsed/float64(sc.period)))
+	return selectUniform(cc, min(max(p, 0), 1))
+}
+
+// cronChurn updates `event_percent` of targets if the cron schedule fires since the previous update,
+// and `update_percent` of targets otherwise.
+type cronChurn struct {
+	schedule *cronSchedule
+	percent  float64
+}
+
+func (cc *cronChurn) selectTargets(ctx *churnContext) []int {
+	if cc.schedule.firesBetween(ctx.prevUpdate, ctx.now) {
+		return selectUniform(ctx, cc.percent)
+	}
+	return selectUniform(ctx, ctx.updatePercent)
+}
+
+// burstChurn updates the given share of targets. It is used for churn bursts triggered via admin API.
+type burstChurn struct {
+	percent float64
+}
+
+func (bc burstChurn) selectTargets(cc *churnContext) []int {
+	return selectUniform(cc, bc.percent)
+}
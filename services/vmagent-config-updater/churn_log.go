@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+var churnLogSize = flag.Int("churnLogSize", 10000, "The maximum number of churn events to keep in memory for /api/v1/churn/events and /api/v1/config/diff")
+
+// churnEvent describes targets changed at a single revision of the job.
+//
+// Targets are identified by their ids, which are used in the target label, e.g. `instance-<id>`.
+type churnEvent struct {
+	Job       string    `json:"job"`
+	Revision  int       `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	Relabeled []int     `json:"relabeled"`
+	Added     []int     `json:"added"`
+	Removed   []int     `json:"removed"`
+
+	// removed contains static configs for the removed targets. They are used for /api/v1/config/diff.
+	removed []*staticConfig
+}
+
+// churnLog is a bounded in-memory log of churn events for all the jobs.
+type churnLog struct {
+	mu     sync.Mutex
+	events []*churnEvent
+
+	// minRevs contains per-job revisions, which are older than the oldest event in the log.
+	minRevs map[string]int
+}
+
+var churnEvents = &churnLog{
+	minRevs: make(map[string]int),
+}
+
+// add registers cr for the given job at the given revision.
+func (cl *churnLog) add(job string, rev int, timestamp time.Time, cr *churnResult) {
+	ev := &churnEvent{
+		Job:       job,
+		Revision:  rev,
+		Timestamp: timestamp,
+		Relabeled: append([]int{}, cr.relabeled...),
+		Added:     append([]int{}, cr.added...),
+		Removed:   make([]int, len(cr.removed)),
+		removed:   cr.removed,
+	}
+	for i, sc := range cr.removed {
+		ev.Removed[i] = sc.id
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.events = append(cl.events, ev)
+	for len(cl.events) > max(*churnLogSize, 0) {
+		evicted := cl.events[0]
+		cl.minRevs[evicted.Job] = evicted.Revision
+		cl.events[0] = nil
+		cl.events = cl.events[1:]
+	}
+}
+
+// resetJob removes events for the given job from cl.
+//
+// It is used when the job is created, since revisions for the re-created job start from scratch.
+func (cl *churnLog) resetJob(job string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	events := cl.events[:0]
+	for _, ev := range cl.events {
+		if ev.Job != job {
+			events = append(events, ev)
+		}
+	}
+	clear(cl.events[len(events):])
+	cl.events = events
+	delete(cl.minRevs, job)
+}
+
+// setMinRevision marks events for the given job up to rev as missing from the log.
+//
+// It is used when the job is restored from -stateFile.
+func (cl *churnLog) setMinRevision(job string, rev int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.minRevs[job] = rev
+}
+
+// getEvents returns up to limit the most recent events for the given job. Events for all the jobs are returned if job is empty.
+func (cl *churnLog) getEvents(job string, limit int) []*churnEvent {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	var evs []*churnEvent
+	for i := len(cl.events) - 1; i >= 0 && len(evs) < limit; i-- {
+		if ev := cl.events[i]; len(job) == 0 || ev.Job == job {
+			evs = append(evs, ev)
+		}
+	}
+	// Return events in chronological order
+	for i, j := 0, len(evs)-1; i < j; i, j = i+1, j-1 {
+		evs[i], evs[j] = evs[j], evs[i]
+	}
+	return evs
+}
+
+// configDiff contains targets changed for the job since the given revision.
+type configDiff struct {
+	Job       string          `json:"job"`
+	From      int             `json:"from"`
+	To        int             `json:"to"`
+	Added     []*staticConfig `json:"added"`
+	Removed   []*staticConfig `json:"removed"`
+	Relabeled []*staticConfig `json:"relabeled"`
+}
+
+// diff returns targets added, removed and relabeled after the from revision.
+//
+// Targets added and then removed after the from revision are omitted from the result.
+func (t *target) diff(from int) (*configDiff, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if from < 0 || from > t.rev {
+		return nil, fmt.Errorf("`from` must be in the range [0..%d] for job %q; got %d", t.rev, t.jobName, from)
+	}
+	added := make(map[int]struct{})
+	relabeled := make(map[int]struct{})
+	removed := make(map[int]*staticConfig)
+
+	cl := churnEvents
+	cl.mu.Lock()
+	if minRev := cl.minRevs[t.jobName]; from < minRev {
+		cl.mu.Unlock()
+		return nil, fmt.Errorf("churn log doesn't contain events for job %q since revision %d; the minimum supported `from` value is %d; "+
+			"increase -churnLogSize for keeping more events", t.jobName, from, minRev)
+	}
+	for _, ev := range cl.events {
+		if ev.Job != t.jobName || ev.Revision <= from {
+			continue
+		}
+		for _, id := range ev.Added {
+			added[id] = struct{}{}
+		}
+		for _, sc := range ev.removed {
+			if _, ok := added[sc.id]; ok {
+				delete(added, sc.id)
+				continue
+			}
+			delete(relabeled, sc.id)
+			removed[sc.id] = sc
+		}
+		for _, id := range ev.Relabeled {
+			if _, ok := added[id]; !ok {
+				relabeled[id] = struct{}{}
+			}
+		}
+	}
+	cl.mu.Unlock()
+
+	d := &configDiff{
+		Job:       t.jobName,
+		From:      from,
+		To:        t.rev,
+		Added:     []*staticConfig{},
+		Removed:   []*staticConfig{},
+		Relabeled: []*staticConfig{},
+	}
+	for _, sc := range t.config.StaticConfigs {
+		if _, ok := added[sc.id]; ok {
+			d.Added = append(d.Added, cloneStaticConfig(sc))
+		}
+		if _, ok := relabeled[sc.id]; ok {
+			d.Relabeled = append(d.Relabeled, cloneStaticConfig(sc))
+		}
+	}
+	for _, sc := range removed {
+		d.Removed = append(d.Removed, sc)
+	}
+	for _, scs := range [][]*staticConfig{d.Added, d.Removed, d.Relabeled} {
+		sort.Slice(scs, func(i, j int) bool {
+			return scs[i].id < scs[j].id
+		})
+	}
+	return d, nil
+}
+
+// cloneStaticConfig returns a copy of sc, which can be used without holding the lock for the target.
+func cloneStaticConfig(sc *staticConfig) *staticConfig {
+	c := *sc
+	c.Labels = maps.Clone(sc.Labels)
+	return &c
+}
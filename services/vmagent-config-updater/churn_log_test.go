@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigDiff(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: diff_job
+  targets_count: 2
+  update_interval: 1m
+  update_percent: 100
+  churn:
+    mode: replace
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	tg := js.getTarget("diff_job")
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+
+	f := func(from string, wantAdded, wantRemoved []string) {
+		t.Helper()
+		resp := serveRequest(h, "/api/v1/config/diff?job=diff_job&from="+from, nil)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d; response: %s", resp.Code, http.StatusOK, resp.Body)
+		}
+		var ds []*configDiff
+		if err := json.Unmarshal(resp.Body.Bytes(), &ds); err != nil {
+			t.Fatalf("cannot parse config diff: %s", err)
+		}
+		if len(ds) != 1 {
+			t.Fatalf("unexpected number of diffs; got %d; want 1", len(ds))
+		}
+		d := ds[0]
+		if added := diffInstances(d.Added); !reflect.DeepEqual(added, wantAdded) {
+			t.Fatalf("unexpected added targets since revision %s; got %q; want %q", from, added, wantAdded)
+		}
+		if removed := diffInstances(d.Removed); !reflect.DeepEqual(removed, wantRemoved) {
+			t.Fatalf("unexpected removed targets since revision %s; got %q; want %q", from, removed, wantRemoved)
+		}
+		if len(d.Relabeled) != 0 {
+			t.Fatalf("unexpected relabeled targets since revision %s: %d", from, len(d.Relabeled))
+		}
+	}
+
+	// instance-2 and instance-3 are added at revision 1 and removed at revision 2, so they are omitted.
+	f("0", []string{"instance-4", "instance-5"}, []string{"instance-0", "instance-1"})
+	f("1", []string{"instance-4", "instance-5"}, []string{"instance-2", "instance-3"})
+	f("2", []string{}, []string{})
+}
+
+func TestConfigDiffTruncatedLog(t *testing.T) {
+	defer func(n int) {
+		*churnLogSize = n
+	}(*churnLogSize)
+	*churnLogSize = 2
+
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: truncated_job
+  targets_count: 10
+  update_interval: 1m
+  update_percent: 100
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	tg := js.getTarget("truncated_job")
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+
+	f := func(from string, wantCode int, wantErr string) {
+		t.Helper()
+		resp := serveRequest(h, "/api/v1/config/diff?job=truncated_job&from="+from, nil)
+		if resp.Code != wantCode {
+			t.Fatalf("unexpected status code for from=%s; got %d; want %d; response: %s", from, resp.Code, wantCode, resp.Body)
+		}
+		if body := resp.Body.String(); !strings.Contains(body, wantErr) {
+			t.Fatalf("response for from=%s must contain %q; got %q", from, wantErr, body)
+		}
+	}
+
+	// Only events for revisions 3 and 4 are kept in the log.
+	f("0", http.StatusBadRequest, "the minimum supported `from` value is 2")
+	f("1", http.StatusBadRequest, "increase -churnLogSize")
+	f("2", http.StatusOK, `"from":2`)
+	f("5", http.StatusBadRequest, "must be in the range [0..4]")
+	f("foo", http.StatusBadRequest, "cannot parse `from` arg")
+}
+
+// diffInstances returns instance labels for scs.
+func diffInstances(scs []*staticConfig) []string {
+	a := make([]string, len(scs))
+	for i, sc := range scs {
+		a[i] = sc.Labels["instance"]
+	}
+	return a
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChurnStrategies(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+
+		// wantUpdated contains the expected number of targets updated at every regular update.
+		wantUpdated []int
+	}{
+		{
+			name: "uniform-all",
+			config: `
+  update_percent: 100`,
+			wantUpdated: []int{100, 100},
+		},
+		{
+			name: "exact",
+			config: `
+  update_percent: 10
+  churn:
+    strategy: exact`,
+			wantUpdated: []int{10, 10, 10},
+		},
+		{
+			name: "storm",
+			config: `
+  update_percent: 0
+  churn:
+    strategy: storm
+    storm_interval: 3m
+    storm_percent: 100`,
+			wantUpdated: []int{0, 0, 100, 0, 0, 100},
+		},
+		{
+			name: "sine-without-amplitude",
+			config: `
+  update_percent: 0
+  churn:
+    strategy: sine
+    period: 1h`,
+			wantUpdated: []int{0, 0, 0},
+		},
+		{
+			name: "exponential-with-huge-lifetime",
+			config: `
+  churn:
+    strategy: exponential
+    mean_lifetime: 10000h`,
+			wantUpdated: []int{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js := &jobs{}
+			applyJobsConfig(t, js, "jobs:\n- job_name: job\n  targets_count: 100\n  update_interval: 1m"+tt.config+"\n")
+			t.Cleanup(func() {
+				js.update(nil)
+			})
+			h := newRequestHandler(js)
+			tg := js.getTarget("job")
+			now := time.Now()
+			for i, want := range tt.wantUpdated {
+				now = now.Add(time.Minute)
+				tg.tick(now)
+				if got := countTargetsWithRevision(t, h, "job", i+1); got != want {
+					t.Fatalf("unexpected number of updated targets at update #%d; got %d; want %d", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStormChurnIgnoresChurnBursts(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 100
+  update_interval: 1m
+  update_percent: 0
+  churn:
+    strategy: storm
+    storm_interval: 3m
+    storm_percent: 100
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	tg := js.getTarget("job")
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+	// Churn bursts increase the revision, but they mustn't shift storms.
+	tg.churnBurst(0)
+	now = now.Add(time.Minute)
+	tg.tick(now)
+	if got := countTargetsWithRevision(t, h, "job", 4); got != 100 {
+		t.Fatalf("unexpected number of targets updated by storm after churn burst; got %d; want 100", got)
+	}
+}
+
+func TestCronChurn(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 50
+  update_interval: 1m
+  update_percent: 0
+  churn:
+    strategy: cron
+    schedule: "0 0 1 1 *"
+    event_percent: 100
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	tg := js.getTarget("job")
+
+	now := time.Now()
+	tg.tick(now.Add(time.Minute))
+	if got := countTargetsWithRevision(t, h, "job", 1); got != 0 {
+		t.Fatalf("unexpected number of updated targets before the schedule fires; got %d; want 0", got)
+	}
+	newYear := time.Date(now.Year()+1, 1, 1, 0, 0, 30, 0, time.Local)
+	tg.tick(newYear)
+	if got := countTargetsWithRevision(t, h, "job", 2); got != 50 {
+		t.Fatalf("unexpected number of updated targets after the schedule fires; got %d; want 50", got)
+	}
+	tg.tick(newYear.Add(time.Minute))
+	if got := countTargetsWithRevision(t, h, "job", 3); got != 0 {
+		t.Fatalf("unexpected number of updated targets after the schedule event; got %d; want 0", got)
+	}
+}
+
+// countTargetsWithRevision returns the number of targets served by h for the given job with labels obtained at the given revision.
+func countTargetsWithRevision(t *testing.T, h http.Handler, job string, rev int) int {
+	t.Helper()
+	resp := serveRequest(h, "/api/v1/sd/"+job, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for http_sd response; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	var scs []*staticConfig
+	if err := json.Unmarshal(resp.Body.Bytes(), &scs); err != nil {
+		t.Fatalf("cannot parse http_sd response: %s", err)
+	}
+	revStr := fmt.Sprintf("r%d", rev)
+	n := 0
+	for _, sc := range scs {
+		if sc.Labels["revision"] == revStr {
+			n++
+		}
+	}
+	return n
+}
+
+func TestResizeChurnStaysAroundTargetsCount(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: job
+  targets_count: 20
+  update_interval: 1m
+  update_percent: 100
+  churn:
+    mode: resize
+    min_targets: 0
+    max_targets: 100
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	tg := js.getTarget("job")
+	now := time.Now()
+	prevCount := 20
+	sum := 0
+	const updates = 500
+	for i := 0; i < updates; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+		n := len(getTargetInstances(t, h, "/api/v1/sd/job"))
+		if prevCount == 0 && n == 0 {
+			t.Fatalf("the number of targets must recover after dropping to zero at update #%d", i+1)
+		}
+		prevCount = n
+		sum += n
+	}
+	if avg := float64(sum) / updates; avg < 10 || avg > 30 {
+		t.Fatalf("the average number of targets must stay around targets_count=20; got %.1f", avg)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	consulListenAddr = flag.String("consulListenAddr", "", "Optional TCP address for serving Consul catalog API emulation with a service per each job, e.g. ':8500'. "+
+		"It can be used for benchmarking consul_sd_configs. See /api/v1/consul/config")
+	consulServer = flag.String("consulServer", "", "The server for consul_sd_configs returned from /api/v1/consul/config. "+
+		"By default it is set to 127.0.0.1<port> if -consulListenAddr contains only port")
+	consulDatacenter   = flag.String("consulDatacenter", "dc1", "The datacenter name returned from Consul catalog API emulation at -consulListenAddr")
+	consulSyncInterval = flag.Duration("consulSyncInterval", time.Second, "How often to check for target changes, which must be sent to blocking queries at -consulListenAddr")
+)
+
+// The default and the maximum wait durations for blocking queries. They match Consul defaults.
+//
+// See https://developer.hashicorp.com/consul/api-docs/features/blocking
+const (
+	consulDefaultWait = 5 * time.Minute
+	consulMaxWait     = 10 * time.Minute
+)
+
+// consulServiceEntry represents a single entry returned from /v1/health/service/<service>.
+//
+// See https://developer.hashicorp.com/consul/api-docs/health#list-service-instances-for-service
+type consulServiceEntry struct {
+	Node    consulNode     `json:"Node"`
+	Service consulService  `json:"Service"`
+	Checks  []*consulCheck `json:"Checks"`
+}
+
+type consulNode struct {
+	ID              string            `json:"ID"`
+	Node            string            `json:"Node"`
+	Address         string            `json:"Address"`
+	Datacenter      string            `json:"Datacenter"`
+	TaggedAddresses map[string]string `json:"TaggedAddresses"`
+	Meta            map[string]string `json:"Meta"`
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Tags    []string          `json:"Tags"`
+	Address string            `json:"Address"`
+	Meta    map[string]string `json:"Meta"`
+	Port    int               `json:"Port"`
+}
+
+type consulCheck struct {
+	Node        string `json:"Node"`
+	CheckID     string `json:"CheckID"`
+	Name        string `json:"Name"`
+	Status      string `json:"Status"`
+	ServiceID   string `json:"ServiceID"`
+	ServiceName string `json:"ServiceName"`
+}
+
+// consulCatalogService holds response for /v1/health/service/<service> for a single job.
+type consulCatalogService struct {
+	// key is the key for the target used for building data.
+	key string
+
+	// ids contains ids for the targets used for building data.
+	ids []int
+
+	// index is the Consul index for the last change of data.
+	index uint64
+	data  []byte
+}
+
+// consulCatalog holds Consul services for the generated targets.
+type consulCatalog struct {
+	mu       sync.Mutex
+	index    uint64
+	services map[string]*consulCatalogService
+
+	// servicesIndex is the Consul index for the last change of the list of services.
+	servicesIndex uint64
+
+	// notifyCh is closed on every change of services.
+	notifyCh chan struct{}
+
+	// ips allocates node IPs. It is used only by sync.
+	ips ipAllocator
+}
+
+func newConsulCatalog() *consulCatalog {
+	// Consul index must be positive. See https://developer.hashicorp.com/consul/api-docs/features/blocking#implementation-details
+	return &consulCatalog{
+		index:         1,
+		servicesIndex: 1,
+		services:      make(map[string]*consulCatalogService),
+		notifyCh:      make(chan struct{}),
+	}
+}
+
+// sync updates services in cc according to targets.
+//
+// Every change increments the Consul index, so blocking queries can detect it.
+func (cc *consulCatalog) sync(targets []*target) {
+	keys := make(map[string]string, len(targets))
+	for _, t := range targets {
+		version, _ := t.getVersion()
+		keys[t.jobName] = fmt.Sprintf("%p:%d", t, version)
+	}
+	jobIDs := make(map[string][]int, len(targets))
+	cc.mu.Lock()
+	var changedTargets []*target
+	for _, t := range targets {
+		if cs := cc.services[t.jobName]; cs == nil || cs.key != keys[t.jobName] {
+			changedTargets = append(changedTargets, t)
+		} else {
+			jobIDs[t.jobName] = cs.ids
+		}
+	}
+	cc.mu.Unlock()
+
+	scss := make([][]*staticConfig, len(changedTargets))
+	for i, t := range changedTargets {
+		scs := t.staticConfigs()
+		ids := make([]int, len(scs))
+		for j, sc := range scs {
+			ids[j] = sc.id
+		}
+		scss[i] = scs
+		jobIDs[t.jobName] = ids
+	}
+	// IPs for unchanged targets remain the same, so their services don't need to be rebuilt.
+	if err := cc.ips.update(jobIDs); err != nil {
+		metrics.getOrCreateCounter(`vmagent_config_updater_consul_ip_allocation_errors_total`).inc()
+		log.Printf("ERROR: Consul catalog API emulation omits services, which cannot obtain node IPs: %s", err)
+	}
+	datas := make([][]byte, len(changedTargets))
+	for i, t := range changedTargets {
+		datas[i] = mustMarshalJSON(consulServiceEntries(t.jobName, scss[i], &cc.ips))
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	changed := false
+	for i, t := range changedTargets {
+		cs := cc.services[t.jobName]
+		if cs == nil {
+			cs = &consulCatalogService{}
+			cc.services[t.jobName] = cs
+			cc.servicesIndex = cc.index + 1
+		}
+		cs.key = keys[t.jobName]
+		cs.ids = jobIDs[t.jobName]
+		if bytes.Equal(cs.data, datas[i]) {
+			continue
+		}
+		cc.index++
+		cs.index = cc.index
+		cs.data = datas[i]
+		changed = true
+	}
+	for name := range cc.services {
+		if _, ok := keys[name]; !ok {
+			delete(cc.services, name)
+			cc.index++
+			cc.servicesIndex = cc.index
+			changed = true
+		}
+	}
+	if changed {
+		close(cc.notifyCh)
+		cc.notifyCh = make(chan struct{})
+	}
+}
+
+// consulServiceEntries returns Consul service entries for the given targets of the given job.
+//
+// Every target is registered on a separate node with IP obtained from ia. Targets without IPs are skipped.
+// Target labels are stored in service meta.
+func consulServiceEntries(jobName string, scs []*staticConfig, ia *ipAllocator) []*consulServiceEntry {
+	entries := make([]*consulServiceEntry, 0, len(scs))
+	for _, sc := range scs {
+		nodeIP := ia.ip(jobName, sc.id)
+		if len(nodeIP) == 0 {
+			continue
+		}
+		node := fmt.Sprintf("%s-%d", k8sName(jobName), sc.id)
+		serviceID := fmt.Sprintf("%s-%d", jobName, sc.id)
+		entries = append(entries, &consulServiceEntry{
+			Node: consulNode{
+				ID:         fmt.Sprintf("node-id-%s", node),
+				Node:       node,
+				Address:    nodeIP,
+				Datacenter: *consulDatacenter,
+				TaggedAddresses: map[string]string{
+					"lan": nodeIP,
+					"wan": nodeIP,
+				},
+				Meta: map[string]string{},
+			},
+			Service: consulService{
+				ID:      serviceID,
+				Service: jobName,
+				Tags:    []string{},
+				Address: nodeIP,
+				Meta:    sc.Labels,
+				Port:    k8sTargetPort(sc.Targets[0]),
+			},
+			Checks: []*consulCheck{
+				{
+					Node:    node,
+					CheckID: "serfHealth",
+					Name:    "Serf Health Status",
+					Status:  "passing",
+				},
+				{
+					Node:        node,
+					CheckID:     "service:" + serviceID,
+					Name:        "Service '" + jobName + "' check",
+					Status:      "passing",
+					ServiceID:   serviceID,
+					ServiceName: jobName,
+				},
+			},
+		})
+	}
+	return entries
+}
+
+// getServices returns response for /v1/catalog/services together with its Consul index.
+func (cc *consulCatalog) getServices() ([]byte, uint64, <-chan struct{}) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	m := make(map[string][]string, len(cc.services))
+	for name := range cc.services {
+		m[name] = []string{}
+	}
+	return mustMarshalJSON(m), cc.servicesIndex, cc.notifyCh
+}
+
+// getService returns response for /v1/health/service/<name> together with its Consul index.
+func (cc *consulCatalog) getService(name string) ([]byte, uint64, <-chan struct{}) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cs := cc.services[name]
+	if cs == nil {
+		return []byte("[]"), cc.index, cc.notifyCh
+	}
+	return cs.data, cs.index, cc.notifyCh
+}
+
+// runConsulAPI serves Consul catalog API emulation at -consulListenAddr.
+func runConsulAPI(js *jobs) {
+	if *consulSyncInterval <= 0 {
+		log.Fatalf("-consulSyncInterval must be positive; got %s", *consulSyncInterval)
+	}
+	cc := newConsulCatalog()
+	cc.sync(js.getTargets())
+	go func() {
+		t := time.NewTicker(*consulSyncInterval)
+		defer t.Stop()
+		for range t.C {
+			cc.sync(js.getTargets())
+		}
+	}()
+	log.Printf("starting Consul catalog API emulation at http://%s/", *consulListenAddr)
+	if err := http.ListenAndServe(*consulListenAddr, newConsulRequestHandler(cc)); err != nil {
+		log.Fatalf("unexpected error when running Consul catalog API emulation: %s", err)
+	}
+}
+
+// newConsulRequestHandler returns handler for Consul catalog API emulation.
+//
+// Only endpoints used by consul_sd_configs are supported. Filtering by tags and node meta is ignored.
+func newConsulRequestHandler(cc *consulCatalog) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/agent/self", instrument("/v1/agent/self", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, map[string]any{
+			"Config": map[string]string{
+				"Datacenter": *consulDatacenter,
+				"NodeName":   "consul-server",
+			},
+		})
+	}))
+	mux.HandleFunc("GET /v1/catalog/services", instrument("/v1/catalog/services", func(w http.ResponseWriter, r *http.Request) {
+		serveConsulBlockingQuery(w, r, cc.getServices)
+	}))
+	mux.HandleFunc("GET /v1/health/service/{service}", instrument("/v1/health/service", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("service")
+		serveConsulBlockingQuery(w, r, func() ([]byte, uint64, <-chan struct{}) {
+			return cc.getService(name)
+		})
+	}))
+	return mux
+}
+
+// serveConsulBlockingQuery serves the response returned by get.
+//
+// If `index` query arg is set, then the response is delayed until its index changes or until `wait` timeout.
+// The response is returned immediately if its index is smaller than the given index, since this means the index has been reset,
+// e.g. after restarting vmagent-config-updater without -stateFile.
+//
+// See https://developer.hashicorp.com/consul/api-docs/features/blocking
+func serveConsulBlockingQuery(w http.ResponseWriter, r *http.Request, get func() ([]byte, uint64, <-chan struct{})) {
+	var minIndex uint64
+	if s := r.FormValue("index"); len(s) > 0 {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse `index`: %s", err), http.StatusBadRequest)
+			return
+		}
+		minIndex = n
+	}
+	wait := consulDefaultWait
+	if s := r.FormValue("wait"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse `wait`: %s", err), http.StatusBadRequest)
+			return
+		}
+		wait = min(d, consulMaxWait)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	data, index, notifyCh := get()
+	for minIndex > 0 && index == minIndex {
+		select {
+		case <-notifyCh:
+		case <-timer.C:
+			minIndex = 0
+		case <-r.Context().Done():
+			return
+		}
+		data, index, notifyCh = get()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-Knownleader", "true")
+	w.Header().Set("X-Consul-Lastcontact", "0")
+	w.Write(data)
+}
+
+// consulServerAddr returns server for consul_sd_configs.
+func consulServerAddr() string {
+	if len(*consulServer) > 0 {
+		return *consulServer
+	}
+	if strings.HasPrefix(*consulListenAddr, ":") {
+		return "127.0.0.1" + *consulListenAddr
+	}
+	return *consulListenAddr
+}
+
+// consulSDConfig represents `consul_sd_config` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#consul_sd_config
+type consulSDConfig struct {
+	Server     string   `yaml:"server"`
+	Datacenter string   `yaml:"datacenter"`
+	Services   []string `yaml:"services"`
+}
+
+// marshalConsul returns scrape config for t, which discovers targets via consul_sd_configs at Consul catalog API emulation.
+//
+// Service meta is converted to target labels, while the target address is set to -targetAddr,
+// so the discovered targets match targets returned from /api/v1/config. The version of t is registered at rk.
+func (t *target) marshalConsul(rk *renderKey) *yaml.Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rk.addLocked(t)
+	sc := *t.config
+	sc.StaticConfigs = nil
+	sc.ConsulSDConfigs = []*consulSDConfig{{
+		Server:     consulServerAddr(),
+		Datacenter: *consulDatacenter,
+		Services:   []string{t.jobName},
+	}}
+	targetAddr := t.targetAddr
+	sc.RelabelConfigs = append([]*relabelConfig{
+		{
+			Action: "labelmap",
+			Regex:  stringOrList{"__meta_consul_service_metadata_(.+)"},
+		},
+		{
+			TargetLabel: "__address__",
+			Replacement: &targetAddr,
+		},
+	}, sc.RelabelConfigs...)
+	n := &yaml.Node{}
+	if err := n.Encode(&sc); err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling scrape config: %s", err)
+	}
+	return n
+}
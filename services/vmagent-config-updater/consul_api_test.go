@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServeConsulBlockingQuery(t *testing.T) {
+	const serverIndex = 5
+	tests := []struct {
+		name      string
+		query     string
+		wantBlock bool
+	}{
+		{
+			name:  "no-index",
+			query: "wait=5s",
+		},
+		{
+			name:  "index-behind-server",
+			query: "index=2&wait=5s",
+		},
+		{
+			name:  "index-ahead-of-server",
+			query: "index=10&wait=5s",
+		},
+		{
+			name:      "index-equals-server",
+			query:     "index=5&wait=100ms",
+			wantBlock: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get := func() ([]byte, uint64, <-chan struct{}) {
+				return []byte(`[]`), serverIndex, make(chan struct{})
+			}
+			r := httptest.NewRequest("GET", "/v1/health/service/job?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			startTime := time.Now()
+			serveConsulBlockingQuery(w, r, get)
+			elapsed := time.Since(startTime)
+
+			if got := w.Header().Get("X-Consul-Index"); got != "5" {
+				t.Fatalf("unexpected X-Consul-Index; got %q; want %q", got, "5")
+			}
+			if got := w.Body.String(); got != `[]` {
+				t.Fatalf("unexpected body; got %q; want %q", got, `[]`)
+			}
+			if tt.wantBlock && elapsed < 100*time.Millisecond {
+				t.Fatalf("expecting the request to block until wait timeout; it returned in %s", elapsed)
+			}
+			if !tt.wantBlock && elapsed > time.Second {
+				t.Fatalf("expecting the request to return immediately; it returned in %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestConsulBlockingQueryAfterChurn(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: consul_job
+  targets_count: 10
+  update_interval: 1m
+  update_percent: 100
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	cc := newConsulCatalog()
+	cc.sync(js.getTargets())
+	h := newConsulRequestHandler(cc)
+
+	resp := serveRequest(h, "/v1/health/service/consul_job", nil)
+	index := resp.Header().Get("X-Consul-Index")
+	if entries := getConsulServiceEntries(t, resp); len(entries) != 10 {
+		t.Fatalf("unexpected number of service entries; got %d; want 10", len(entries))
+	}
+
+	respCh := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		respCh <- serveRequest(h, "/v1/health/service/consul_job?wait=10s&index="+index, nil)
+	}()
+	select {
+	case <-respCh:
+		t.Fatalf("blocking query mustn't return before the churn")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	js.getTarget("consul_job").tick(time.Now())
+	cc.sync(js.getTargets())
+	select {
+	case resp := <-respCh:
+		newIndex, _ := strconv.ParseUint(resp.Header().Get("X-Consul-Index"), 10, 64)
+		prevIndex, _ := strconv.ParseUint(index, 10, 64)
+		if newIndex <= prevIndex {
+			t.Fatalf("X-Consul-Index must increase after the churn; got %d; previous index %d", newIndex, prevIndex)
+		}
+		for _, e := range getConsulServiceEntries(t, resp) {
+			if rev := e.Service.Meta["revision"]; rev != "r1" {
+				t.Fatalf("unexpected revision for service %s after the churn; got %q; want %q", e.Service.ID, rev, "r1")
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking query must return after the churn")
+	}
+}
+
+func TestConsulNodeIPs(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: foo
+  targets_count: 300
+- job_name: bar
+  targets_count: 300
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	cc := newConsulCatalog()
+	cc.sync(js.getTargets())
+	h := newConsulRequestHandler(cc)
+
+	nodes := make(map[string]string)
+	for _, job := range []string{"foo", "bar"} {
+		for _, e := range getConsulServiceEntries(t, serveRequest(h, "/v1/health/service/"+job, nil)) {
+			if prev, ok := nodes[e.Node.Address]; ok {
+				t.Fatalf("duplicate IP %s for nodes %s and %s", e.Node.Address, prev, e.Node.Node)
+			}
+			nodes[e.Node.Address] = e.Node.Node
+		}
+	}
+	if len(nodes) != 600 {
+		t.Fatalf("unexpected number of nodes; got %d; want 600", len(nodes))
+	}
+}
+
+func getConsulServiceEntries(t *testing.T, resp *httptest.ResponseRecorder) []*consulServiceEntry {
+	t.Helper()
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	var entries []*consulServiceEntry
+	if err := json.Unmarshal(resp.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("cannot parse service entries: %s", err)
+	}
+	return entries
+}
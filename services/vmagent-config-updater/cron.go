@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron schedule in the standard 5-field format: minute hour day-of-month month day-of-week.
+//
+// Every field supports `*`, single values, ranges `a-b`, steps `*/n` and `a-b/n` and comma-separated lists of these.
+type cronSchedule struct {
+	minutes []bool
+	hours   []bool
+	doms    []bool
+	months  []bool
+	dows    []bool
+	domStar bool
+	dowStar bool
+}
+
+// maxCronLookback limits the number of minutes to check in cronSchedule.firesBetween.
+const maxCronLookback = 7 * 24 * 60
+
+func parseCronSchedule(s string) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule must contain 5 fields; got %d fields in %q", len(fields), s)
+	}
+	var cs cronSchedule
+	var err error
+	if cs.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cannot parse minute: %w", err)
+	}
+	if cs.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cannot parse hour: %w", err)
+	}
+	if cs.doms, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cannot parse day of month: %w", err)
+	}
+	if cs.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cannot parse month: %w", err)
+	}
+	if cs.dows, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cannot parse day of week: %w", err)
+	}
+	// Both 0 and 7 mean Sunday
+	cs.dows[0] = cs.dows[0] || cs.dows[7]
+	// Fields starting with `*` such as `*/2` are treated as unrestricted in the same way as standard cron does.
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return &cs, nil
+}
+
+func parseCronField(s string, minValue, maxValue int) ([]bool, error) {
+	set := make([]bool, maxValue+1)
+	for _, part := range strings.Split(s, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		start, end := minValue, maxValue
+		if rangeStr != "*" {
+			startStr, endStr, isRange := strings.Cut(rangeStr, "-")
+			n, err := strconv.Atoi(startStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", startStr)
+			}
+			start, end = n, n
+			if isRange {
+				if end, err = strconv.Atoi(endStr); err != nil {
+					return nil, fmt.Errorf("invalid value %q", endStr)
+				}
+			} else if hasStep {
+				end = maxValue
+			}
+		}
+		if start < minValue || end > maxValue || start > end {
+			return nil, fmt.Errorf("%q is out of range [%d..%d]", part, minValue, maxValue)
+		}
+		for i := start; i <= end; i += step {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) matches(t time.Time) bool {
+	if !cs.minutes[t.Minute()] || !cs.hours[t.Hour()] || !cs.months[t.Month()] {
+		return false
+	}
+	domMatch := cs.doms[t.Day()]
+	dowMatch := cs.dows[t.Weekday()]
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	// Standard cron semantics: if both day fields are restricted, then either of them must match.
+	return domMatch || dowMatch
+}
+
+// firesBetween returns true if cs fires in the time range (start..end].
+func (cs *cronSchedule) firesBetween(start, end time.Time) bool {
+	t := start.Truncate(time.Minute).Add(time.Minute)
+	if end.Sub(t) > maxCronLookback*time.Minute {
+		t = end.Add(-maxCronLookback * time.Minute).Truncate(time.Minute)
+	}
+	for ; !t.After(end); t = t.Add(time.Minute) {
+		if cs.matches(t) {
+			return true
+		}
+	}
+	return false
+}
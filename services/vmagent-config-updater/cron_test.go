@@ -0,0 +1,245 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		minValue int
+		maxValue int
+		want     []int
+	}{
+		{
+			name:     "star",
+			s:        "*",
+			minValue: 1,
+			maxValue: 5,
+			want:     []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:     "single-value",
+			s:        "7",
+			minValue: 0,
+			maxValue: 59,
+			want:     []int{7},
+		},
+		{
+			name:     "range",
+			s:        "3-6",
+			minValue: 0,
+			maxValue: 59,
+			want:     []int{3, 4, 5, 6},
+		},
+		{
+			name:     "star-step",
+			s:        "*/15",
+			minValue: 0,
+			maxValue: 59,
+			want:     []int{0, 15, 30, 45},
+		},
+		{
+			name:     "range-step",
+			s:        "10-20/5",
+			minValue: 0,
+			maxValue: 59,
+			want:     []int{10, 15, 20},
+		},
+		{
+			name:     "value-step",
+			s:        "50/4",
+			minValue: 0,
+			maxValue: 59,
+			want:     []int{50, 54, 58},
+		},
+		{
+			name:     "list",
+			s:        "1,3-4,*/10",
+			minValue: 0,
+			maxValue: 23,
+			want:     []int{0, 1, 3, 4, 10, 20},
+		},
+		{
+			name:     "bounds",
+			s:        "1,31",
+			minValue: 1,
+			maxValue: 31,
+			want:     []int{1, 31},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := parseCronField(tt.s, tt.minValue, tt.maxValue)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var got []int
+			for i, ok := range set {
+				if ok {
+					got = append(got, i)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("unexpected values for %q; got %v; want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronScheduleFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{name: "empty", s: ""},
+		{name: "too-few-fields", s: "* * * *"},
+		{name: "too-many-fields", s: "* * * * * *"},
+		{name: "minute-too-big", s: "60 * * * *"},
+		{name: "hour-too-big", s: "* 24 * * *"},
+		{name: "zero-day-of-month", s: "* * 0 * *"},
+		{name: "month-too-big", s: "* * * 13 *"},
+		{name: "day-of-week-too-big", s: "* * * * 8"},
+		{name: "negative-value", s: "-1 * * * *"},
+		{name: "reversed-range", s: "10-5 * * * *"},
+		{name: "zero-step", s: "*/0 * * * *"},
+		{name: "negative-step", s: "*/-2 * * * *"},
+		{name: "non-numeric-value", s: "foo * * * *"},
+		{name: "non-numeric-range-end", s: "1-x * * * *"},
+		{name: "non-numeric-step", s: "*/x * * * *"},
+		{name: "empty-list-item", s: "1,,2 * * * *"},
+		{name: "named-month", s: "* * * JAN *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCronSchedule(tt.s); err == nil {
+				t.Fatalf("expecting non-nil error for %q", tt.s)
+			}
+		})
+	}
+}
+
+func TestCronScheduleFiresBetween(t *testing.T) {
+	// 2024-01-01 is Monday
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule string
+		start    time.Time
+		end      time.Time
+		want     bool
+	}{
+		{
+			name:     "every-minute",
+			schedule: "* * * * *",
+			start:    base,
+			end:      base.Add(time.Minute),
+			want:     true,
+		},
+		{
+			name:     "start-is-excluded",
+			schedule: "0 10 * * *",
+			start:    base,
+			end:      base.Add(30 * time.Second),
+			want:     false,
+		},
+		{
+			name:     "end-is-included",
+			schedule: "5 10 * * *",
+			start:    base,
+			end:      base.Add(5 * time.Minute),
+			want:     true,
+		},
+		{
+			name:     "step-between-fires",
+			schedule: "*/15 * * * *",
+			start:    base.Add(time.Minute),
+			end:      base.Add(14 * time.Minute),
+			want:     false,
+		},
+		{
+			name:     "step-fires",
+			schedule: "*/15 * * * *",
+			start:    base.Add(time.Minute),
+			end:      base.Add(15 * time.Minute),
+			want:     true,
+		},
+		{
+			name:     "day-of-week-matches",
+			schedule: "0 12 * * 1",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     true,
+		},
+		{
+			name:     "day-of-week-mismatches",
+			schedule: "0 12 * * 2",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     false,
+		},
+		{
+			name:     "sunday-as-7",
+			schedule: "0 0 * * 7",
+			start:    base.Add(-48 * time.Hour),
+			end:      base,
+			want:     true,
+		},
+		{
+			name:     "restricted-day-of-month-or-day-of-week",
+			schedule: "0 12 15 * 1",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     true,
+		},
+		{
+			name:     "restricted-day-of-month-with-star-day-of-week",
+			schedule: "0 12 15 * *",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     false,
+		},
+		{
+			name:     "day-of-month-step-with-restricted-day-of-week",
+			schedule: "0 12 */2 * 2",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     false,
+		},
+		{
+			name:     "day-of-week-step-with-restricted-day-of-month",
+			schedule: "0 12 1 * */2",
+			start:    base,
+			end:      base.Add(3 * time.Hour),
+			want:     false,
+		},
+		{
+			name:     "month-mismatches",
+			schedule: "* * * 2-12 *",
+			start:    base,
+			end:      base.Add(time.Hour),
+			want:     false,
+		},
+		{
+			name:     "long-gap-is-limited",
+			schedule: "0 10 1 1 *",
+			start:    base.Add(-time.Minute),
+			end:      base.Add(30 * 24 * time.Hour),
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := parseCronSchedule(tt.schedule)
+			if err != nil {
+				t.Fatalf("cannot parse %q: %s", tt.schedule, err)
+			}
+			if got := cs.firesBetween(tt.start, tt.end); got != tt.want {
+				t.Fatalf("unexpected result for %q in (%s..%s]; got %v; want %v", tt.schedule, tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// distribution describes skewed distribution of targets among label values or among churned targets.
+//
+// It is set in the form `uniform`, `zipf:<exponent>` or `normal:<stddev>`, where stddev is relative to the number of items.
+// nil distribution is uniform.
+type distribution struct {
+	kind  string
+	param float64
+
+	// cdfs caches cumulative weights per the number of items for pick, since pick is called for every target.
+	cdfsLock sync.Mutex
+	cdfs     map[int][]float64
+}
+
+// parseDistribution parses distribution from s. It returns nil for uniform distribution.
+func parseDistribution(s string) (*distribution, error) {
+	kind, param, hasParam := strings.Cut(s, ":")
+	var d distribution
+	d.kind = kind
+	switch kind {
+	case "", "uniform":
+		if hasParam {
+			return nil, fmt.Errorf("uniform distribution doesn't accept params; got %q", s)
+		}
+		return nil, nil
+	case "zipf":
+		d.param = 1
+	case "normal":
+		d.param = 0.2
+	default:
+		return nil, fmt.Errorf("unsupported distribution %q; supported values: uniform, zipf:<exponent>, normal:<stddev>", s)
+	}
+	if hasParam {
+		v, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse param for %s distribution: %w", kind, err)
+		}
+		if v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("param for %s distribution must be positive; got %v", kind, v)
+		}
+		d.param = v
+	}
+	return &d, nil
+}
+
+func (d *distribution) String() string {
+	if d == nil {
+		return "uniform"
+	}
+	return fmt.Sprintf("%s:%g", d.kind, d.param)
+}
+
+// weights returns normalized weights for n items, so their sum equals to 1.
+//
+// Items with smaller indexes are hot for zipf distribution, while items in the middle are hot for normal distribution.
+// nil is returned for uniform distribution.
+func (d *distribution) weights(n int) []float64 {
+	if d == nil || n == 0 {
+		return nil
+	}
+	ws := make([]float64, n)
+	sum := 0.0
+	for i := range ws {
+		switch d.kind {
+		case "zipf":
+			ws[i] = 1 / math.Pow(float64(i+1), d.param)
+		case "normal":
+			x := (float64(i) - float64(n-1)/2) / (d.param * float64(n))
+			ws[i] = math.Exp(-x * x / 2)
+		}
+		sum += ws[i]
+	}
+	for i := range ws {
+		ws[i] /= sum
+	}
+	return ws
+}
+
+// pick returns item index in the range [0..n) for u in the range [0..1) according to d.
+func (d *distribution) pick(u float64, n int) int {
+	if d == nil {
+		return int(u * float64(n))
+	}
+	cdf := d.cdf(n)
+	i := sort.Search(len(cdf), func(i int) bool {
+		return u < cdf[i]
+	})
+	return min(i, n-1)
+}
+
+// cdf returns cumulative weights for n items according to d.
+func (d *distribution) cdf(n int) []float64 {
+	d.cdfsLock.Lock()
+	defer d.cdfsLock.Unlock()
+	if cdf, ok := d.cdfs[n]; ok {
+		return cdf
+	}
+	cdf := d.weights(n)
+	for i := 1; i < len(cdf); i++ {
+		cdf[i] += cdf[i-1]
+	}
+	if d.cdfs == nil {
+		d.cdfs = make(map[int][]float64)
+	}
+	d.cdfs[n] = cdf
+	return cdf
+}
+
+// split splits n items among len(ws) buckets according to ws, so the sum of the returned counts equals to n.
+//
+// Items are evenly split if ws is nil.
+func split(n int, ws []float64, buckets int) []int {
+	counts := make([]int, buckets)
+	if ws == nil {
+		for i := range counts {
+			counts[i] = n / buckets
+			if i < n%buckets {
+				counts[i]++
+			}
+		}
+		return counts
+	}
+	// Use the largest remainder method, so the counts are as close to n*ws as possible.
+	remainders := make([]int, buckets)
+	total := 0
+	for i, w := range ws {
+		counts[i] = int(float64(n) * w)
+		total += counts[i]
+		remainders[i] = i
+	}
+	sort.SliceStable(remainders, func(i, j int) bool {
+		a, b := remainders[i], remainders[j]
+		return float64(n)*ws[a]-float64(counts[a]) > float64(n)*ws[b]-float64(counts[b])
+	})
+	for i := 0; total < n; i++ {
+		counts[remainders[i%buckets]]++
+		total++
+	}
+	return counts
+}
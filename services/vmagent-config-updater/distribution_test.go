@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseDistribution(t *testing.T) {
+	f := func(s, want string) {
+		t.Helper()
+		d, err := parseDistribution(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if got := d.String(); got != want {
+			t.Fatalf("unexpected distribution for %q; got %q; want %q", s, got, want)
+		}
+	}
+	f("", "uniform")
+	f("uniform", "uniform")
+	f("zipf", "zipf:1")
+	f("zipf:1.5", "zipf:1.5")
+	f("normal", "normal:0.2")
+	f("normal:0.05", "normal:0.05")
+
+	for _, s := range []string{"uniform:1", "pareto", "zipf:", "zipf:foo", "zipf:0", "zipf:-1", "zipf:Inf", "normal:NaN"} {
+		if _, err := parseDistribution(s); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+}
+
+func TestDistributionPick(t *testing.T) {
+	f := func(s string, n int) {
+		t.Helper()
+		d, err := parseDistribution(s)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", s, err)
+		}
+		const samples = 100000
+		seed := jobSeed("job")
+		counts := make([]int, n)
+		for i := 0; i < samples; i++ {
+			idx := d.pick(randFloat64(seed, 1, i), n)
+			if idx < 0 || idx >= n {
+				t.Fatalf("picked index %d is out of range [0..%d) for %s", idx, n, s)
+			}
+			counts[idx]++
+		}
+		ws := d.weights(n)
+		for i, count := range counts {
+			want := 1 / float64(n)
+			if ws != nil {
+				want = ws[i]
+			}
+			if got := float64(count) / samples; math.Abs(got-want) > 0.01 {
+				t.Fatalf("unexpected share for item #%d for %s; got %.4f; want %.4f", i, s, got, want)
+			}
+		}
+	}
+	f("uniform", 5)
+	f("zipf", 5)
+	f("zipf", 1)
+	f("normal:0.3", 5)
+
+	// Cached weights for distinct n don't interfere.
+	f("zipf:2", 3)
+	d, _ := parseDistribution("zipf:2")
+	if idx := d.pick(0.99, 3); idx != 2 {
+		t.Fatalf("unexpected pick for n=3; got %d; want 2", idx)
+	}
+	if idx := d.pick(0.99, 100); idx == 2 {
+		t.Fatalf("unexpected pick for n=100; got %d", idx)
+	}
+}
+
+func TestLabelDistribution(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: label_dist_job
+  targets_count: 2000
+  label_distribution: zipf
+  labels:
+    tenant: '{{ .Pick "a" "b" "c" "d" }}'
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	resp := serveRequest(h, "/api/v1/sd/label_dist_job", nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for http_sd response; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	var scs []*staticConfig
+	if err := json.Unmarshal(resp.Body.Bytes(), &scs); err != nil {
+		t.Fatalf("cannot parse http_sd response: %s", err)
+	}
+	counts := make(map[string]int)
+	for _, sc := range scs {
+		counts[sc.Labels["tenant"]]++
+	}
+
+	// zipf weights for 4 items are 1, 1/2, 1/3 and 1/4 normalized by their sum 25/12.
+	want := map[string]float64{"a": 0.48, "b": 0.24, "c": 0.16, "d": 0.12}
+	for tenant, share := range want {
+		if got := float64(counts[tenant]) / float64(len(scs)); math.Abs(got-share) > 0.03 {
+			t.Fatalf("unexpected share of targets for tenant %q; got %.3f; want %.3f", tenant, got, share)
+		}
+	}
+}
+
+func TestChurnDistribution(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: churn_dist_job
+  targets_count: 100
+  update_interval: 1m
+  update_percent: 10
+  churn:
+    strategy: exact
+    distribution: zipf
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	tg := js.getTarget("churn_dist_job")
+	now := time.Now()
+	const updates = 100
+	for i := 0; i < updates; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+
+	// The exact strategy updates update_percent of targets at every revision, while hot targets are updated more frequently.
+	relabeled := make(map[int]int)
+	revisions := 0
+	for _, ev := range churnEvents.getEvents("churn_dist_job", *churnLogSize) {
+		if ev.Revision == 0 {
+			continue
+		}
+		revisions++
+		if len(ev.Relabeled) != 10 {
+			t.Fatalf("unexpected number of relabeled targets at revision %d; got %d; want 10", ev.Revision, len(ev.Relabeled))
+		}
+		for _, id := range ev.Relabeled {
+			relabeled[id]++
+		}
+	}
+	if revisions != updates {
+		t.Fatalf("unexpected number of churn events; got %d; want %d", revisions, updates)
+	}
+	hot := relabeled[0] + relabeled[1] + relabeled[2]
+	cold := relabeled[97] + relabeled[98] + relabeled[99]
+	if hot <= 2*cold {
+		t.Fatalf("hot targets must be relabeled more frequently than cold targets; got %d vs %d updates", hot, cold)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	fileSDDir = flag.String("fileSDDir", "", "Optional path to directory for writing target groups per each job in file_sd_configs format. "+
+		"Files are atomically re-written on every scrape config update, so they can be used for benchmarking file_sd_configs. "+
+		"See also -fileSDFormat")
+	fileSDFormat = flag.String("fileSDFormat", "json", "Format for files written to -fileSDDir. Supported values: json, yaml")
+)
+
+// initFileSD validates -fileSDFormat and creates -fileSDDir if needed.
+func initFileSD() {
+	if len(*fileSDDir) == 0 {
+		return
+	}
+	switch *fileSDFormat {
+	case "json", "yaml":
+	default:
+		log.Fatalf("unsupported -fileSDFormat=%q; supported values: json, yaml", *fileSDFormat)
+	}
+	if err := os.MkdirAll(*fileSDDir, 0o755); err != nil {
+		log.Fatalf("cannot create -fileSDDir=%q: %s", *fileSDDir, err)
+	}
+}
+
+// validateFileSDJobName verifies that job can be used as a file name inside -fileSDDir.
+func validateFileSDJobName(job string) error {
+	if job == "" || job == "." || job == ".." || strings.ContainsAny(job, "/\\\x00") {
+		return fmt.Errorf("job name %q cannot be used as a file name in -fileSDDir; it mustn't be empty, . or .. and mustn't contain slashes", job)
+	}
+	return nil
+}
+
+// writeFileSD writes target groups for t to -fileSDDir.
+//
+// The file is written to a temporary file at first and then is renamed to the final path,
+// so readers never see partially written file. Concurrent writes for t are serialized,
+// so the file always contains the most recent target groups.
+func (t *target) writeFileSD() error {
+	if len(*fileSDDir) == 0 {
+		return nil
+	}
+	t.fileSDMu.Lock()
+	defer t.fileSDMu.Unlock()
+	var data []byte
+	if *fileSDFormat == "yaml" {
+		data = t.marshalFileSDYAML()
+	} else {
+		data = t.marshalSD(allShards, nil)
+	}
+	return writeFileAtomic(t.fileSDPath(), data)
+}
+
+// removeFileSD removes file_sd for t from -fileSDDir.
+func (t *target) removeFileSD() error {
+	if len(*fileSDDir) == 0 {
+		return nil
+	}
+	t.fileSDMu.Lock()
+	defer t.fileSDMu.Unlock()
+	if err := os.Remove(t.fileSDPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (t *target) fileSDPath() string {
+	return filepath.Join(*fileSDDir, t.jobName+"."+*fileSDFormat)
+}
+
+func (t *target) marshalFileSDYAML() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, err := yaml.Marshal(t.config.StaticConfigs)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling file_sd target groups: %s", err)
+	}
+	return data
+}
+
+// writeFileAtomic writes data to path via a unique temporary file in the same directory,
+// so concurrent writers never share the temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file for %q: %w", path, err)
+	}
+	tmpPath := f.Name()
+	if err := writeAndSync(f, data); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("cannot write %q: %w", tmpPath, err)
+	}
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("cannot set permissions for %q: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("cannot rename %q to %q: %w", tmpPath, path, err)
+	}
+	return nil
+}
+
+// writeAndSync writes data to f, flushes it to disk and closes f.
+func writeAndSync(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	basicAuthUsername     = newArrayFlag("basicAuthUsername", "", "Optional basic_auth username to set at the scrape config returned from -httpListenAddr")
+	basicAuthPasswordFile = newArrayFlag("basicAuthPasswordFile", "", "Optional path to basic_auth password file to set at the scrape config returned from -httpListenAddr")
+	authorizationType     = newArrayFlag("authorizationType", "", "Optional authorization type to set at the scrape config returned from -httpListenAddr. "+
+		"Bearer is used by default if -authorizationCredentialsFile is set")
+	authorizationCredentialsFile = newArrayFlag("authorizationCredentialsFile", "", "Optional path to authorization credentials file to set at the scrape config returned from -httpListenAddr")
+	oauth2ClientID               = newArrayFlag("oauth2ClientID", "", "Optional oauth2 client_id to set at the scrape config returned from -httpListenAddr")
+	oauth2ClientSecretFile       = newArrayFlag("oauth2ClientSecretFile", "", "Optional path to oauth2 client secret file to set at the scrape config returned from -httpListenAddr")
+	oauth2TokenURL               = newArrayFlag("oauth2TokenURL", "", "Optional oauth2 token_url to set at the scrape config returned from -httpListenAddr")
+	oauth2Scopes                 = newArrayFlag("oauth2Scopes", "", "Optional oauth2 scopes to set at the scrape config returned from -httpListenAddr. Multiple scopes must be delimited by ';'")
+	tlsCAFile                    = newArrayFlag("tlsCAFile", "", "Optional path to CA file to set at tls_config of the scrape config returned from -httpListenAddr")
+	tlsCertFile                  = newArrayFlag("tlsCertFile", "", "Optional path to client certificate file to set at tls_config of the scrape config returned from -httpListenAddr")
+	tlsKeyFile                   = newArrayFlag("tlsKeyFile", "", "Optional path to client key file to set at tls_config of the scrape config returned from -httpListenAddr")
+	tlsServerName                = newArrayFlag("tlsServerName", "", "Optional server_name to set at tls_config of the scrape config returned from -httpListenAddr")
+	tlsInsecureSkipVerify        = newArrayFlag("tlsInsecureSkipVerify", false, "Whether to set insecure_skip_verify: true at tls_config of the scrape config returned from -httpListenAddr")
+	proxyURL                     = newArrayFlag("proxyURL", "", "Optional proxy_url to set at the scrape config returned from -httpListenAddr")
+)
+
+// httpConfig represents HTTP configuration for scrape, such as auth params
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config
+type httpConfig struct {
+	BearerTokenFile string               `yaml:"bearer_token_file,omitempty"`
+	BasicAuth       *basicAuthConfig     `yaml:"basic_auth,omitempty"`
+	Authorization   *authorizationConfig `yaml:"authorization,omitempty"`
+	OAuth2          *oauth2Config        `yaml:"oauth2,omitempty"`
+	TLSConfig       *tlsConfig           `yaml:"tls_config,omitempty"`
+	ProxyURL        string               `yaml:"proxy_url,omitempty"`
+}
+
+// basicAuthConfig represents `basic_auth` section of Prometheus config.
+type basicAuthConfig struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// authorizationConfig represents `authorization` section of Prometheus config.
+type authorizationConfig struct {
+	Type            string `yaml:"type,omitempty"`
+	CredentialsFile string `yaml:"credentials_file,omitempty"`
+}
+
+// oauth2Config represents `oauth2` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#oauth2
+type oauth2Config struct {
+	ClientID         string   `yaml:"client_id"`
+	ClientSecretFile string   `yaml:"client_secret_file,omitempty"`
+	TokenURL         string   `yaml:"token_url"`
+	Scopes           []string `yaml:"scopes,omitempty"`
+}
+
+// tlsConfig represents `tls_config` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#tls_config
+type tlsConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// newHTTPConfig returns httpConfig for the job with the given idx from command-line flags.
+//
+// nil is returned if no HTTP options are set for the job.
+func newHTTPConfig(idx int) *httpConfig {
+	hc := &httpConfig{
+		ProxyURL: proxyURL.getArg(idx),
+	}
+	if targetRequiresK8sAuth.getArg(idx) {
+		hc.BearerTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if username := basicAuthUsername.getArg(idx); len(username) > 0 {
+		hc.BasicAuth = &basicAuthConfig{
+			Username:     username,
+			PasswordFile: basicAuthPasswordFile.getArg(idx),
+		}
+	}
+	if credentialsFile := authorizationCredentialsFile.getArg(idx); len(credentialsFile) > 0 {
+		hc.Authorization = &authorizationConfig{
+			Type:            authorizationType.getArg(idx),
+			CredentialsFile: credentialsFile,
+		}
+	}
+	if clientID := oauth2ClientID.getArg(idx); len(clientID) > 0 {
+		var scopes []string
+		if s := oauth2Scopes.getArg(idx); len(s) > 0 {
+			scopes = strings.Split(s, ";")
+		}
+		hc.OAuth2 = &oauth2Config{
+			ClientID:         clientID,
+			ClientSecretFile: oauth2ClientSecretFile.getArg(idx),
+			TokenURL:         oauth2TokenURL.getArg(idx),
+			Scopes:           scopes,
+		}
+	}
+	tc := &tlsConfig{
+		CAFile:             tlsCAFile.getArg(idx),
+		CertFile:           tlsCertFile.getArg(idx),
+		KeyFile:            tlsKeyFile.getArg(idx),
+		ServerName:         tlsServerName.getArg(idx),
+		InsecureSkipVerify: tlsInsecureSkipVerify.getArg(idx),
+	}
+	if *tc != (tlsConfig{}) {
+		hc.TLSConfig = tc
+	}
+	if *hc == (httpConfig{}) {
+		return nil
+	}
+	return hc
+}
+
+// validate verifies auth and TLS options at hc.
+func (hc *httpConfig) validate() error {
+	authMethods := 0
+	if len(hc.BearerTokenFile) > 0 {
+		authMethods++
+	}
+	if hc.BasicAuth != nil {
+		if len(hc.BasicAuth.Username) == 0 {
+			return fmt.Errorf("missing `username` at `basic_auth`")
+		}
+		authMethods++
+	}
+	if hc.Authorization != nil {
+		authMethods++
+	}
+	if hc.OAuth2 != nil {
+		if len(hc.OAuth2.ClientID) == 0 || len(hc.OAuth2.TokenURL) == 0 {
+			return fmt.Errorf("`oauth2` requires both `client_id` and `token_url`")
+		}
+		authMethods++
+	}
+	if authMethods > 1 {
+		return fmt.Errorf("only one of `bearer_token_file`, `basic_auth`, `authorization` and `oauth2` can be set")
+	}
+	if tc := hc.TLSConfig; tc != nil && (len(tc.CertFile) > 0) != (len(tc.KeyFile) > 0) {
+		return fmt.Errorf("`cert_file` and `key_file` must be set together at `tls_config`")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// ipBlocksCount is the number of per-job blocks in 10.0.0.0/8. Every block is /16 subnet.
+const ipBlocksCount = 256
+
+// ipBlockSize is the number of IPs in a single block excluding network and broadcast addresses of every /24 subnet.
+const ipBlockSize = 256 * 254
+
+// ipAllocator allocates unique IPs from 10.0.0.0/8 for targets of all the jobs.
+//
+// Every job obtains its own block, which is selected by the hash of the job name, so the block doesn't depend
+// on the position and the number of other jobs. The next free block is used if the block is already used by another job.
+// Targets obtain IPs within the block of their job according to their ids, so IPs remain stable while targets exist.
+// IPs of removed targets are re-used, so the number of IPs is limited only by the number of the existing targets for the job.
+//
+// ipAllocator must be used from a single goroutine.
+type ipAllocator struct {
+	blocks map[string]*ipBlock
+
+	// usedBlocks contains jobs for the used blocks.
+	usedBlocks [ipBlocksCount]string
+}
+
+// ipBlock contains IPs allocated for targets of a single job.
+type ipBlock struct {
+	idx int
+
+	// slots maps target ids to slots in the block.
+	slots map[int]int
+
+	// used contains target ids for the used slots.
+	used map[int]int
+}
+
+// update allocates IPs for targets with the given ids per each job and releases IPs for the missing jobs and targets.
+//
+// An error is returned if some targets cannot obtain IPs because the block for their job is exhausted
+// or because there are no free blocks. Other targets obtain IPs in this case.
+func (ia *ipAllocator) update(jobIDs map[string][]int) error {
+	if ia.blocks == nil {
+		ia.blocks = make(map[string]*ipBlock)
+	}
+	for job, b := range ia.blocks {
+		if _, ok := jobIDs[job]; !ok {
+			ia.usedBlocks[b.idx] = ""
+			delete(ia.blocks, job)
+		}
+	}
+	var errs []string
+	for _, job := range sortedKeys(jobIDs) {
+		b := ia.blocks[job]
+		if b == nil {
+			b = ia.newBlock(job)
+			if b == nil {
+				errs = append(errs, fmt.Sprintf("cannot allocate IPs for job %q, since all the %d blocks in 10.0.0.0/8 are used by other jobs", job, ipBlocksCount))
+				continue
+			}
+		}
+		if n := b.update(jobIDs[job]); n > 0 {
+			errs = append(errs, fmt.Sprintf("cannot allocate IPs for %d targets of job %q, since the number of targets exceeds %d", n, job, ipBlockSize))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors; the first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// newBlock returns free block for the given job or nil if all the blocks are used.
+func (ia *ipAllocator) newBlock(job string) *ipBlock {
+	h := fnv.New32a()
+	h.Write([]byte(job))
+	start := int(h.Sum32() % ipBlocksCount)
+	for i := 0; i < ipBlocksCount; i++ {
+		idx := (start + i) % ipBlocksCount
+		if len(ia.usedBlocks[idx]) > 0 {
+			continue
+		}
+		b := &ipBlock{
+			idx:   idx,
+			slots: make(map[int]int),
+			used:  make(map[int]int),
+		}
+		ia.usedBlocks[idx] = job
+		ia.blocks[job] = b
+		return b
+	}
+	return nil
+}
+
+// ip returns IP for the target with the given id at the given job.
+//
+// Empty string is returned if the target has no IP.
+func (ia *ipAllocator) ip(job string, id int) string {
+	b := ia.blocks[job]
+	if b == nil {
+		return ""
+	}
+	slot, ok := b.slots[id]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("10.%d.%d.%d", b.idx, slot/254, slot%254+1)
+}
+
+// blockIndex returns the index of the block for the given job or -1 if the job has no block.
+func (ia *ipAllocator) blockIndex(job string) int {
+	if b := ia.blocks[job]; b != nil {
+		return b.idx
+	}
+	return -1
+}
+
+// update allocates slots for the given ids and releases slots for the missing ids.
+//
+// It returns the number of ids, which cannot obtain slots.
+func (b *ipBlock) update(ids []int) int {
+	live := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		live[id] = struct{}{}
+	}
+	for id, slot := range b.slots {
+		if _, ok := live[id]; !ok {
+			delete(b.slots, id)
+			delete(b.used, slot)
+		}
+	}
+	var newIDs []int
+	for _, id := range ids {
+		if _, ok := b.slots[id]; !ok {
+			newIDs = append(newIDs, id)
+		}
+	}
+	// Allocate slots in the order of ids, so the allocation doesn't depend on the order of targets.
+	sort.Ints(newIDs)
+	for i, id := range newIDs {
+		if len(b.used) >= ipBlockSize {
+			return len(newIDs) - i
+		}
+		slot := id % ipBlockSize
+		for {
+			if _, ok := b.used[slot]; !ok {
+				break
+			}
+			slot = (slot + 1) % ipBlockSize
+		}
+		b.slots[id] = slot
+		b.used[slot] = id
+	}
+	return 0
+}
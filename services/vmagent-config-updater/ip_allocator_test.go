@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+)
+
+func TestIPAllocatorUniqueIPs(t *testing.T) {
+	var ia ipAllocator
+	jobIDs := map[string][]int{
+		"foo": seqIDs(0, 1000),
+		"bar": seqIDs(0, 1000),
+		"baz": seqIDs(5000, 1000),
+	}
+	if err := ia.update(jobIDs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	seen := make(map[string]string)
+	for job, ids := range jobIDs {
+		for _, id := range ids {
+			ip := ia.ip(job, id)
+			if len(ip) == 0 {
+				t.Fatalf("missing IP for target %d at job %q", id, job)
+			}
+			if strings.HasSuffix(ip, ".0") || strings.HasSuffix(ip, ".255") {
+				t.Fatalf("unexpected network or broadcast IP %s for target %d at job %q", ip, id, job)
+			}
+			key := fmt.Sprintf("%s/%d", job, id)
+			if prev, ok := seen[ip]; ok {
+				t.Fatalf("duplicate IP %s for %s and %s", ip, prev, key)
+			}
+			seen[ip] = key
+		}
+	}
+}
+
+func TestIPAllocatorStableBlocks(t *testing.T) {
+	var ia ipAllocator
+	if err := ia.update(map[string][]int{"foo": {1, 2}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ip := ia.ip("foo", 1)
+
+	// The IP doesn't depend on other jobs.
+	var ia2 ipAllocator
+	if err := ia2.update(map[string][]int{"aaa": {1, 2}, "foo": {1, 2}, "zzz": {1, 2}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := ia2.ip("foo", 1); got != ip {
+		t.Fatalf("IP must be independent of other jobs; got %s; want %s", got, ip)
+	}
+
+	// The IP remains stable while the target exists, while IPs of removed targets are released.
+	if err := ia.update(map[string][]int{"foo": {1, 3}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := ia.ip("foo", 1); got != ip {
+		t.Fatalf("IP must remain stable for the existing target; got %s; want %s", got, ip)
+	}
+	if got := ia.ip("foo", 2); len(got) > 0 {
+		t.Fatalf("IP must be released for the removed target; got %s", got)
+	}
+}
+
+func TestIPAllocatorBlockCollision(t *testing.T) {
+	// Find jobs with colliding hashes.
+	blockOf := func(job string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(job))
+		return h.Sum32() % ipBlocksCount
+	}
+	first := "job_0"
+	second := ""
+	for i := 1; len(second) == 0; i++ {
+		if job := fmt.Sprintf("job_%d", i); blockOf(job) == blockOf(first) {
+			second = job
+		}
+	}
+	var ia ipAllocator
+	if err := ia.update(map[string][]int{first: {0}, second: {0}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ia.ip(first, 0) == ia.ip(second, 0) {
+		t.Fatalf("jobs %q and %q with colliding hashes must obtain distinct IPs; got %s", first, second, ia.ip(first, 0))
+	}
+}
+
+func TestIPAllocatorExhausted(t *testing.T) {
+	var ia ipAllocator
+	err := ia.update(map[string][]int{"foo": seqIDs(0, ipBlockSize+10)})
+	if err == nil || !strings.Contains(err.Error(), "cannot allocate IPs for 10 targets") {
+		t.Fatalf("unexpected error for exhausted block: %v", err)
+	}
+	if ip := ia.ip("foo", ipBlockSize-1); len(ip) == 0 {
+		t.Fatalf("targets, which fit the block, must obtain IPs")
+	}
+
+	jobIDs := make(map[string][]int)
+	for i := 0; i < ipBlocksCount+1; i++ {
+		jobIDs[fmt.Sprintf("job_%d", i)] = []int{0}
+	}
+	ia = ipAllocator{}
+	err = ia.update(jobIDs)
+	if err == nil || !strings.Contains(err.Error(), "all the 256 blocks in 10.0.0.0/8 are used") {
+		t.Fatalf("unexpected error for exhausted blocks: %v", err)
+	}
+}
+
+func seqIDs(start, n int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = start + i
+	}
+	return ids
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configPath = flag.String("config", "", "Optional path to YAML file with job definitions. "+
+		"Per-job command-line flags such as -jobName and -targetsCount cannot be set when -config is set. "+
+		"The file is re-read on SIGHUP and on changes detected every -configCheckInterval")
+	configCheckInterval = flag.Duration("configCheckInterval", 5*time.Second, "Interval for checking for changes in -config file. Set it to zero for disabling periodic checks")
+)
+
+// jobConfig describes a single scrape job generated by vmagent-config-updater.
+type jobConfig struct {
+	// ScrapeConfig contains options, which are passed to the generated scrape config as is.
+	ScrapeConfig scrapeConfig `yaml:",inline"`
+
+	TargetsCount   int           `yaml:"targets_count"`
+	TargetAddr     string        `yaml:"target_addr,omitempty"`
+	LabelName      string        `yaml:"label_name,omitempty"`
+	UpdateInterval time.Duration `yaml:"update_interval,omitempty"`
+	UpdatePercent  *float64      `yaml:"update_percent,omitempty"`
+	Churn          churnConfig   `yaml:"churn,omitempty"`
+
+	LoadProfile loadProfileConfig `yaml:"load_profile,omitempty"`
+	Topology    topologyConfig    `yaml:"topology,omitempty"`
+
+	// Labels contains templates for extra target labels. See labelTemplates.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// LabelDistribution is the distribution of targets among label values. See distribution.
+	LabelDistribution string `yaml:"label_distribution,omitempty"`
+}
+
+// jobsFile represents the contents of -config file.
+type jobsFile struct {
+	Jobs []*jobConfig `yaml:"jobs"`
+}
+
+// loadJobConfigs returns job configs either from -config file or from per-job command-line flags.
+func loadJobConfigs() ([]*jobConfig, error) {
+	if len(*configPath) > 0 {
+		var err error
+		flag.Visit(func(f *flag.Flag) {
+			for _, pf := range perJobFlags {
+				if pf.flagName() == f.Name {
+					err = fmt.Errorf("-%s cannot be set together with -config", f.Name)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read -config=%q: %w", *configPath, err)
+		}
+		return parseJobConfigs(data)
+	}
+	return jobConfigsFromFlags()
+}
+
+// parseJobConfigs parses and validates job configs from data.
+func parseJobConfigs(data []byte) ([]*jobConfig, error) {
+	var jf jobsFile
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&jf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot parse job configs: %w", err)
+	}
+	for _, jc := range jf.Jobs {
+		if jc == nil {
+			return nil, fmt.Errorf("job config cannot be empty")
+		}
+		jc.setDefaults()
+	}
+	if err := validateJobConfigs(jf.Jobs); err != nil {
+		return nil, err
+	}
+	return jf.Jobs, nil
+}
+
+// jobConfigsFromFlags returns job configs from per-job command-line flags.
+func jobConfigsFromFlags() ([]*jobConfig, error) {
+	jobsCount := len(jobName.total())
+	for _, pf := range perJobFlags {
+		if n := pf.valuesCount(); n > 1 && n != jobsCount {
+			return nil, fmt.Errorf("-%s has %d values, while -jobName has %d values", pf.flagName(), n, jobsCount)
+		}
+	}
+	jcs := make([]*jobConfig, jobsCount)
+	for i := range jcs {
+		updatePercent := scrapeConfigUpdatePercent.getArg(i)
+		jc := &jobConfig{
+			ScrapeConfig: scrapeConfig{
+				JobName:        jobName.getArg(i),
+				ScrapeInterval: scrapeInterval.getArg(i),
+			},
+			TargetsCount:   targetsCount.getArg(i),
+			TargetAddr:     targetAddr.getArg(i),
+			LabelName:      labelName.getArg(i),
+			UpdateInterval: scrapeConfigUpdateInterval.getArg(i),
+			UpdatePercent:  &updatePercent,
+			Churn:          churnConfigFromFlags(i),
+			LoadProfile:    loadProfileConfigFromFlags(i),
+			Topology:       topologyConfigFromFlags(i),
+
+			LabelDistribution: labelDistribution.getArg(i),
+		}
+		labels, err := parseTargetLabelsFlag(targetLabels.getArg(i))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -targetLabels for job %q: %w", jc.ScrapeConfig.JobName, err)
+		}
+		jc.Labels = labels
+		sc := &jc.ScrapeConfig
+		if err := sc.setOptions(i); err != nil {
+			return nil, fmt.Errorf("invalid scrape options for job %q: %w", sc.JobName, err)
+		}
+		if path := scrapeConfigRelabel.getArg(i); len(path) > 0 {
+			rcs, err := loadRelabelConfigs(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load relabel_configs for job %q: %w", sc.JobName, err)
+			}
+			sc.RelabelConfigs = rcs
+		}
+		if path := scrapeConfigMetricRelabel.getArg(i); len(path) > 0 {
+			rcs, err := loadRelabelConfigs(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load metric_relabel_configs for job %q: %w", sc.JobName, err)
+			}
+			sc.MetricRelabelConfigs = rcs
+		}
+		jcs[i] = jc
+	}
+	if err := validateJobConfigs(jcs); err != nil {
+		return nil, err
+	}
+	return jcs, nil
+}
+
+// setDefaults sets default values from command-line flags for missing options at jc.
+func (jc *jobConfig) setDefaults() {
+	if len(jc.TargetAddr) == 0 {
+		jc.TargetAddr = targetAddr.defaultValue
+	}
+	if len(jc.LabelName) == 0 {
+		jc.LabelName = labelName.defaultValue
+	}
+	if jc.ScrapeConfig.ScrapeInterval == 0 {
+		jc.ScrapeConfig.ScrapeInterval = scrapeInterval.defaultValue
+	}
+	if jc.UpdateInterval == 0 {
+		jc.UpdateInterval = scrapeConfigUpdateInterval.defaultValue
+	}
+	if jc.UpdatePercent == nil {
+		updatePercent := scrapeConfigUpdatePercent.defaultValue
+		jc.UpdatePercent = &updatePercent
+	}
+	if len(jc.Churn.Strategy) == 0 {
+		jc.Churn.Strategy = churnStrategyName.defaultValue
+	}
+	if len(jc.Churn.Mode) == 0 {
+		jc.Churn.Mode = churnMode.defaultValue
+	}
+	jc.Topology.setDefaults()
+}
+
+func validateJobConfigs(jcs []*jobConfig) error {
+	if len(jcs) == 0 {
+		return fmt.Errorf("at least a single job must be configured")
+	}
+	seen := make(map[string]struct{}, len(jcs))
+	for _, jc := range jcs {
+		name := jc.ScrapeConfig.JobName
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("duplicate job_name %q", name)
+		}
+		seen[name] = struct{}{}
+		if err := jc.validate(); err != nil {
+			return fmt.Errorf("invalid config for job %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (jc *jobConfig) validate() error {
+	if err := jc.ScrapeConfig.validate(); err != nil {
+		return err
+	}
+	if len(*fileSDDir) > 0 {
+		if err := validateFileSDJobName(jc.ScrapeConfig.JobName); err != nil {
+			return err
+		}
+	}
+	if jc.TargetsCount <= 0 {
+		return fmt.Errorf("`targets_count` must be positive; got %d", jc.TargetsCount)
+	}
+	if jc.UpdateInterval <= 0 {
+		return fmt.Errorf("`update_interval` must be positive; got %s", jc.UpdateInterval)
+	}
+	if err := validatePercent("update_percent", *jc.UpdatePercent); err != nil {
+		return err
+	}
+	if _, err := newChurnStrategy(&jc.Churn); err != nil {
+		return fmt.Errorf("invalid `churn` config: %w", err)
+	}
+	if err := jc.Churn.validateMode(jc.TargetsCount); err != nil {
+		return fmt.Errorf("invalid `churn` config: %w", err)
+	}
+	if _, err := parseDistribution(jc.Churn.Distribution); err != nil {
+		return fmt.Errorf("invalid `distribution` at `churn` config: %w", err)
+	}
+	if err := jc.LoadProfile.validate(); err != nil {
+		return fmt.Errorf("invalid `load_profile` config: %w", err)
+	}
+	if jc.LoadProfile.isSet() && jc.Churn.Mode == "resize" {
+		return fmt.Errorf("`load_profile` cannot be used together with `mode: resize` at `churn` config")
+	}
+	if err := jc.Topology.validate(); err != nil {
+		return fmt.Errorf("invalid `topology` config: %w", err)
+	}
+	reserved := []string{jc.LabelName, "revision"}
+	if jc.Topology.isSet() {
+		reserved = append(reserved, topologyLabelNames...)
+	}
+	if err := validateLabelTemplates(jc.Labels, jc.ScrapeConfig.JobName, reserved); err != nil {
+		return fmt.Errorf("invalid `labels` config: %w", err)
+	}
+	if _, err := parseDistribution(jc.LabelDistribution); err != nil {
+		return fmt.Errorf("invalid `label_distribution`: %w", err)
+	}
+	if jc.Topology.isSet() && jc.Churn.Mode != "relabel" {
+		return fmt.Errorf("`topology` cannot be used together with `mode: %s` at `churn` config", jc.Churn.Mode)
+	}
+	return nil
+}
+
+// jobs holds targets for all the configured jobs.
+type jobs struct {
+	mu      sync.RWMutex
+	targets []*target
+	byName  map[string]*target
+
+	// configs contains job configs without overrides from the current scenario phase.
+	configs []*jobConfig
+
+	// phase is the current scenario phase. It is nil if -scenario isn't set.
+	phase      *scenarioPhase
+	phaseStart time.Time
+
+	// overrides contains per-job overrides set via admin API. They are applied on top of the scenario phase.
+	overrides map[string]*jobOverrides
+}
+
+// update applies jcs to js with overrides from the current scenario phase.
+//
+// js remains unchanged if some of the new jobs cannot be started.
+func (js *jobs) update(jcs []*jobConfig) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	prevConfigs := js.configs
+	js.configs = jcs
+	if err := js.applyLocked(); err != nil {
+		js.configs = prevConfigs
+		return err
+	}
+	return nil
+}
+
+// setPhase applies overrides from the given scenario phase to js.
+func (js *jobs) setPhase(p *scenarioPhase) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.phase = p
+	js.phaseStart = time.Now()
+	if err := js.applyLocked(); err != nil {
+		log.Printf("cannot apply scenario phase %q: %s", p.Name, err)
+	}
+}
+
+// effectiveConfigLocked returns jc with overrides from the current scenario phase and the given admin API overrides.
+//
+// It must be called under js.mu.
+func (js *jobs) effectiveConfigLocked(jc *jobConfig, po *jobOverrides) (*jobConfig, error) {
+	if js.phase != nil {
+		pjc, err := js.phase.apply(jc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot apply scenario phase %q: %w", js.phase.Name, err)
+		}
+		jc = pjc
+	}
+	if po != nil {
+		ojc := *jc
+		po.apply(&ojc)
+		ojc.setDefaults()
+		if err := ojc.validate(); err != nil {
+			return nil, fmt.Errorf("cannot apply overrides from admin API: %w", err)
+		}
+		jc = &ojc
+	}
+	return jc, nil
+}
+
+// setOverrides merges po into admin API overrides for the job with the given name and applies them.
+//
+// Overrides are preserved across -config reloads and scenario phases.
+func (js *jobs) setOverrides(jobName string, po *jobOverrides) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var jc *jobConfig
+	for _, c := range js.configs {
+		if c.ScrapeConfig.JobName == jobName {
+			jc = c
+		}
+	}
+	if jc == nil {
+		return fmt.Errorf("unknown job %q", jobName)
+	}
+	var merged jobOverrides
+	if prev := js.overrides[jobName]; prev != nil {
+		merged = *prev
+	}
+	merged.merge(po)
+	if _, err := js.effectiveConfigLocked(jc, &merged); err != nil {
+		return err
+	}
+	if js.overrides == nil {
+		js.overrides = make(map[string]*jobOverrides)
+	}
+	js.overrides[jobName] = &merged
+	return js.applyLocked()
+}
+
+// resetOverrides removes admin API overrides for the job with the given name.
+func (js *jobs) resetOverrides(jobName string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	delete(js.overrides, jobName)
+	if err := js.applyLocked(); err != nil {
+		log.Printf("cannot reset admin API overrides for job %q: %s", jobName, err)
+	}
+}
+
+// getPhase returns the current scenario phase and its start time.
+func (js *jobs) getPhase() (*scenarioPhase, time.Time) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.phase, js.phaseStart
+}
+
+// applyLocked applies js.configs with overrides from js.phase to js.
+//
+// Targets for existing jobs are updated in place, so they preserve their churn state.
+// Targets for new jobs are started, while targets for removed jobs are stopped.
+// js remains unchanged if some of the new jobs cannot be started.
+//
+// It must be called under js.mu.
+func (js *jobs) applyLocked() error {
+	jcs := make([]*jobConfig, len(js.configs))
+	for i, jc := range js.configs {
+		ejc, err := js.effectiveConfigLocked(jc, js.overrides[jc.ScrapeConfig.JobName])
+		if err != nil {
+			log.Printf("%s; using the job config without overrides for job %q", err, jc.ScrapeConfig.JobName)
+			ejc = jc
+		}
+		jcs[i] = ejc
+	}
+
+	started := make(map[string]*target)
+	for _, jc := range jcs {
+		name := jc.ScrapeConfig.JobName
+		if js.byName[name] != nil {
+			continue
+		}
+		t := newTarget(jc)
+		if err := t.start(); err != nil {
+			for _, t := range started {
+				t.stop()
+			}
+			return fmt.Errorf("cannot start job %q: %w", name, err)
+		}
+		started[name] = t
+	}
+
+	targets := make([]*target, 0, len(jcs))
+	byName := make(map[string]*target, len(jcs))
+	for _, jc := range jcs {
+		name := jc.ScrapeConfig.JobName
+		t := started[name]
+		if t == nil {
+			t = js.byName[name]
+			t.update(jc)
+			// The update may relabel or remove targets, so file_sd must be refreshed in the same way as after churn.
+			if err := t.writeFileSD(); err != nil {
+				log.Printf("cannot write file_sd for job %q: %s", name, err)
+			}
+		}
+		targets = append(targets, t)
+		byName[name] = t
+	}
+	for name, t := range js.byName {
+		if _, ok := byName[name]; !ok {
+			t.stop()
+		}
+	}
+	js.targets = targets
+	js.byName = byName
+	return nil
+}
+
+func (js *jobs) getTargets() []*target {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.targets
+}
+
+func (js *jobs) getTarget(jobName string) *target {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.byName[jobName]
+}
+
+// watchConfig reloads -config on SIGHUP and on file changes detected every -configCheckInterval.
+func (js *jobs) watchConfig() {
+	sighupCh := make(chan os.Signal, 1)
+	signal.Notify(sighupCh, syscall.SIGHUP)
+	var tickerCh <-chan time.Time
+	if *configCheckInterval > 0 {
+		ticker := time.NewTicker(*configCheckInterval)
+		defer ticker.Stop()
+		tickerCh = ticker.C
+	}
+	prevData, err := os.ReadFile(*configPath)
+	if err != nil {
+		log.Printf("cannot read -config=%q: %s", *configPath, err)
+	}
+	for {
+		select {
+		case <-sighupCh:
+			log.Printf("SIGHUP received; reloading -config=%q", *configPath)
+		case <-tickerCh:
+		}
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			log.Printf("cannot read -config=%q: %s; continuing with the previous config", *configPath, err)
+			continue
+		}
+		if bytes.Equal(data, prevData) {
+			continue
+		}
+		jcs, err := parseJobConfigs(data)
+		if err != nil {
+			log.Printf("cannot reload -config=%q: %s; continuing with the previous config", *configPath, err)
+			continue
+		}
+		if err := js.update(jcs); err != nil {
+			log.Printf("cannot apply -config=%q: %s; continuing with the previous config", *configPath, err)
+			continue
+		}
+		prevData = data
+		log.Printf("successfully reloaded -config=%q with %d jobs", *configPath, len(jcs))
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	k8sAPIListenAddr = flag.String("k8sAPIListenAddr", "", "Optional TCP address for serving fake Kubernetes API with pods, endpoints, endpointslices and nodes for the generated targets, e.g. ':8437'. "+
+		"It can be used for benchmarking kubernetes_sd_configs. See /api/v1/k8s/config")
+	k8sAPIServerURL = flag.String("k8sAPIServerURL", "", "The api_server url for kubernetes_sd_configs returned from /api/v1/k8s/config. "+
+		"By default it is set to http://127.0.0.1<port> if -k8sAPIListenAddr contains only port")
+	k8sRole         = flag.String("k8sRole", "pod", "The role for kubernetes_sd_configs returned from /api/v1/k8s/config. Supported values: pod, endpoints, endpointslice")
+	k8sNodesCount   = flag.Int("k8sNodesCount", 10, "The number of nodes served by -k8sAPIListenAddr. Pods are evenly spread among nodes")
+	k8sSyncInterval = flag.Duration("k8sSyncInterval", time.Second, "How often to check for target changes, which must be sent to watchers at -k8sAPIListenAddr")
+	k8sWatchHistory = flag.Int("k8sWatchHistory", 100000, "The maximum number of object changes to keep in memory for watch requests with resourceVersion at -k8sAPIListenAddr. "+
+		"Older resourceVersion values result in 410 Gone error, so the watcher must re-list objects")
+)
+
+// k8sResources contains resources served by fake Kubernetes API.
+var k8sResources = map[string]struct {
+	apiVersion string
+	listKind   string
+}{
+	"pods":           {"v1", "PodList"},
+	"services":       {"v1", "ServiceList"},
+	"endpoints":      {"v1", "EndpointsList"},
+	"endpointslices": {"discovery.k8s.io/v1", "EndpointSliceList"},
+	"nodes":          {"v1", "NodeList"},
+}
+
+// k8sStoredObject is a Kubernetes object stored in k8sStore.
+type k8sStoredObject struct {
+	namespace string
+	obj       any
+
+	// spec is JSON representation of obj without resourceVersion. It is used for detecting object changes.
+	spec []byte
+
+	// data is JSON representation of obj with resourceVersion.
+	data []byte
+}
+
+// k8sEvent is a single change of Kubernetes object.
+type k8sEvent struct {
+	resource  string
+	namespace string
+	rv        uint64
+
+	// line is JSON-encoded watch event with the trailing newline.
+	line []byte
+}
+
+// k8sStore holds Kubernetes objects for the generated targets and the history of their changes for watch requests.
+type k8sStore struct {
+	mu      sync.Mutex
+	rv      uint64
+	objects map[string]map[string]*k8sStoredObject
+	events  []*k8sEvent
+
+	// minRV is the resourceVersion for the most recent event evicted from events.
+	minRV uint64
+
+	// notifyCh is closed on every change of objects.
+	notifyCh chan struct{}
+
+	// cacheKey is the key for targets used for building the current objects. See targetsCacheKey.
+	cacheKey string
+
+	// ips allocates pod IPs. It is used only by sync.
+	ips ipAllocator
+}
+
+func newK8sStore() *k8sStore {
+	return &k8sStore{
+		objects:  make(map[string]map[string]*k8sStoredObject),
+		notifyCh: make(chan struct{}),
+	}
+}
+
+// sync updates objects in ks according to targets and registers events for changed objects.
+func (ks *k8sStore) sync(targets []*target) {
+	key := targetsCacheKey(targets)
+	ks.mu.Lock()
+	unchanged := key == ks.cacheKey
+	ks.mu.Unlock()
+	if unchanged {
+		return
+	}
+	startTime := time.Now()
+	objs, err := buildK8sObjects(targets, *k8sNodesCount, &ks.ips)
+	if err != nil {
+		metrics.getOrCreateCounter(`vmagent_config_updater_k8s_ip_allocation_errors_total`).inc()
+		log.Printf("ERROR: fake Kubernetes API omits pods, which cannot obtain IPs: %s", err)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.cacheKey = key
+	changed := false
+	for _, resource := range sortedKeys(k8sResources) {
+		m := objs[resource]
+		stored := ks.objects[resource]
+		if stored == nil {
+			stored = make(map[string]*k8sStoredObject)
+			ks.objects[resource] = stored
+		}
+		for _, k := range sortedKeys(m) {
+			obj := m[k]
+			spec := mustMarshalJSON(obj)
+			so := stored[k]
+			eventType := "ADDED"
+			if so != nil {
+				if bytes.Equal(so.spec, spec) {
+					continue
+				}
+				eventType = "MODIFIED"
+			}
+			so = &k8sStoredObject{
+				namespace: k8sObjectMetadata(obj).Namespace,
+				obj:       obj,
+				spec:      spec,
+			}
+			stored[k] = so
+			ks.addEventLocked(resource, eventType, so)
+			changed = true
+		}
+		for _, k := range sortedKeys(stored) {
+			if _, ok := m[k]; ok {
+				continue
+			}
+			so := stored[k]
+			delete(stored, k)
+			ks.addEventLocked(resource, "DELETED", so)
+			changed = true
+		}
+	}
+	if changed {
+		close(ks.notifyCh)
+		ks.notifyCh = make(chan struct{})
+	}
+	metrics.getOrCreateHistogram(`vmagent_config_updater_k8s_sync_duration_seconds`).updateDuration(startTime)
+}
+
+// addEventLocked assigns new resourceVersion to so and registers the event with the given type for it.
+//
+// It must be called under ks.mu.
+func (ks *k8sStore) addEventLocked(resource, eventType string, so *k8sStoredObject) {
+	ks.rv++
+	k8sObjectMetadata(so.obj).ResourceVersion = strconv.FormatUint(ks.rv, 10)
+	so.data = mustMarshalJSON(so.obj)
+	ks.events = append(ks.events, &k8sEvent{
+		resource:  resource,
+		namespace: so.namespace,
+		rv:        ks.rv,
+		line:      marshalK8sWatchEvent(eventType, so.data),
+	})
+	for len(ks.events) > max(*k8sWatchHistory, 0) {
+		ks.minRV = ks.events[0].rv
+		ks.events[0] = nil
+		ks.events = ks.events[1:]
+	}
+	metrics.getOrCreateCounter(`vmagent_config_updater_k8s_events_total{resource=` + quoteLabelValue(resource) + `,type=` + quoteLabelValue(eventType) + `}`).inc()
+}
+
+// list returns objects for the given resource and namespace together with the current resourceVersion.
+//
+// Objects for all the namespaces are returned if namespace is empty.
+func (ks *k8sStore) list(resource, namespace string) ([][]byte, uint64) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	stored := ks.objects[resource]
+	var items [][]byte
+	for _, k := range sortedKeys(stored) {
+		if so := stored[k]; len(namespace) == 0 || so.namespace == namespace {
+			items = append(items, so.data)
+		}
+	}
+	return items, ks.rv
+}
+
+// getEvents returns events for the given resource and namespace after the given resourceVersion.
+//
+// It also returns the resourceVersion to pass to the next getEvents call and the channel, which is closed on the next change.
+// False is returned if events after the given resourceVersion are missing in the history.
+func (ks *k8sStore) getEvents(resource, namespace string, rv uint64) ([]*k8sEvent, uint64, <-chan struct{}, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if rv < ks.minRV {
+		return nil, rv, nil, false
+	}
+	n := sort.Search(len(ks.events), func(i int) bool {
+		return ks.events[i].rv > rv
+	})
+	var evs []*k8sEvent
+	for _, ev := range ks.events[n:] {
+		if ev.resource == resource && (len(namespace) == 0 || ev.namespace == namespace) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, max(rv, ks.rv), ks.notifyCh, true
+}
+
+// runK8sAPI serves fake Kubernetes API at -k8sAPIListenAddr.
+func runK8sAPI(js *jobs) {
+	ks := newK8sStore()
+	ks.sync(js.getTargets())
+	go func() {
+		t := time.NewTicker(*k8sSyncInterval)
+		defer t.Stop()
+		for range t.C {
+			ks.sync(js.getTargets())
+		}
+	}()
+	log.Printf("starting fake Kubernetes API at http://%s/", *k8sAPIListenAddr)
+	if err := http.ListenAndServe(*k8sAPIListenAddr, newK8sRequestHandler(ks)); err != nil {
+		log.Fatalf("unexpected error when running the fake Kubernetes API server: %s", err)
+	}
+}
+
+// newK8sRequestHandler returns handler for the fake Kubernetes API.
+//
+// Only list and watch requests are supported. Label selectors, field selectors and pagination are ignored.
+func newK8sRequestHandler(ks *k8sStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, map[string]string{
+			"major":      "1",
+			"minor":      "30",
+			"gitVersion": "v1.30.0",
+			"platform":   "linux/amd64",
+		})
+	})
+	for resource, ri := range k8sResources {
+		prefix := "/api/v1"
+		if ri.apiVersion != "v1" {
+			prefix = "/apis/" + ri.apiVersion
+		}
+		path := prefix + "/" + resource
+		mux.HandleFunc("GET "+path, instrument(path, func(w http.ResponseWriter, r *http.Request) {
+			serveK8sResource(ks, w, r, resource, "")
+		}))
+		if resource == "nodes" {
+			continue
+		}
+		nsPath := prefix + "/namespaces/{namespace}/" + resource
+		mux.HandleFunc("GET "+nsPath, instrument(path, func(w http.ResponseWriter, r *http.Request) {
+			serveK8sResource(ks, w, r, resource, r.PathValue("namespace"))
+		}))
+	}
+	return mux
+}
+
+func serveK8sResource(ks *k8sStore, w http.ResponseWriter, r *http.Request, resource, namespace string) {
+	switch r.FormValue("watch") {
+	case "1", "true":
+		serveK8sWatch(ks, w, r, resource, namespace)
+		return
+	}
+	items, rv := ks.list(resource, namespace)
+	ri := k8sResources[resource]
+	var bb bytes.Buffer
+	fmt.Fprintf(&bb, `{"kind":%q,"apiVersion":%q,"metadata":{"resourceVersion":"%d"},"items":[`, ri.listKind, ri.apiVersion, rv)
+	for i, data := range items {
+		if i > 0 {
+			bb.WriteByte(',')
+		}
+		bb.Write(data)
+	}
+	bb.WriteString("]}")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bb.Bytes())
+}
+
+func serveK8sWatch(ks *k8sStore, w http.ResponseWriter, r *http.Request, resource, namespace string) {
+	timeout := 30 * time.Minute
+	if s := r.FormValue("timeoutSeconds"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("`timeoutSeconds` must be positive integer; got %q", s), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(n) * time.Second
+	}
+	var rv uint64
+	sendInitialEvents := true
+	if s := r.FormValue("resourceVersion"); len(s) > 0 && s != "0" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse `resourceVersion`: %s", err), http.StatusBadRequest)
+			return
+		}
+		rv = n
+		sendInitialEvents = false
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Fatalf("BUG: %T doesn't implement http.Flusher", w)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if sendInitialEvents {
+		var items [][]byte
+		items, rv = ks.list(resource, namespace)
+		for _, data := range items {
+			w.Write(marshalK8sWatchEvent("ADDED", data))
+		}
+		flusher.Flush()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		evs, nextRV, notifyCh, ok := ks.getEvents(resource, namespace, rv)
+		if !ok {
+			w.Write(marshalK8sWatchEvent("ERROR", []byte(fmt.Sprintf(`{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure",`+
+				`"message":"too old resource version: %d","reason":"Expired","code":410}`, rv))))
+			flusher.Flush()
+			return
+		}
+		for _, ev := range evs {
+			w.Write(ev.line)
+		}
+		if len(evs) > 0 {
+			flusher.Flush()
+		}
+		rv = nextRV
+		select {
+		case <-notifyCh:
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// marshalK8sWatchEvent returns watch event with the given type for the given JSON-encoded object.
+func marshalK8sWatchEvent(eventType string, data []byte) []byte {
+	var bb bytes.Buffer
+	fmt.Fprintf(&bb, `{"type":%q,"object":`, eventType)
+	bb.Write(data)
+	bb.WriteString("}\n")
+	return bb.Bytes()
+}
+
+func mustMarshalJSON(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling %T: %s", v, err)
+	}
+	return data
+}
+
+// k8sAPIServer returns api_server url for kubernetes_sd_configs.
+func k8sAPIServer() string {
+	if len(*k8sAPIServerURL) > 0 {
+		return *k8sAPIServerURL
+	}
+	if strings.HasPrefix(*k8sAPIListenAddr, ":") {
+		return "http://127.0.0.1" + *k8sAPIListenAddr
+	}
+	return "http://" + *k8sAPIListenAddr
+}
+
+// kubernetesSDConfig represents `kubernetes_sd_config` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#kubernetes_sd_config
+type kubernetesSDConfig struct {
+	Role       string               `yaml:"role"`
+	APIServer  string               `yaml:"api_server"`
+	Namespaces *k8sNamespacesConfig `yaml:"namespaces,omitempty"`
+}
+
+type k8sNamespacesConfig struct {
+	Names []string `yaml:"names"`
+}
+
+// k8sLabelPrefixes contains prefixes for meta-labels with object labels per each supported -k8sRole.
+//
+// The node role isn't supported, since it discovers -k8sNodesCount nodes instead of the generated targets,
+// so it cannot reproduce target labels and target churn.
+var k8sLabelPrefixes = map[string]string{
+	"pod":           "__meta_kubernetes_pod_label_",
+	"endpoints":     "__meta_kubernetes_pod_label_",
+	"endpointslice": "__meta_kubernetes_pod_label_",
+}
+
+// initK8sAPI validates command-line flags for the fake Kubernetes API.
+func initK8sAPI() {
+	if _, ok := k8sLabelPrefixes[*k8sRole]; !ok {
+		log.Fatalf("unsupported -k8sRole=%q; supported values: pod, endpoints, endpointslice", *k8sRole)
+	}
+	if *k8sNodesCount <= 0 {
+		log.Fatalf("-k8sNodesCount must be positive; got %d", *k8sNodesCount)
+	}
+	if *k8sSyncInterval <= 0 {
+		log.Fatalf("-k8sSyncInterval must be positive; got %s", *k8sSyncInterval)
+	}
+}
+
+// marshalK8s returns scrape config for t, which discovers targets via kubernetes_sd_configs at the fake Kubernetes API.
+//
+// Labels of the discovered objects are converted to target labels, while the target address is set to -targetAddr,
+// so the discovered targets match targets returned from /api/v1/config. The version of t is registered at rk.
+func (t *target) marshalK8s(rk *renderKey) *yaml.Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rk.addLocked(t)
+	sc := *t.config
+	sc.StaticConfigs = nil
+	sc.KubernetesSDConfigs = []*kubernetesSDConfig{{
+		Role:      *k8sRole,
+		APIServer: k8sAPIServer(),
+		Namespaces: &k8sNamespacesConfig{
+			Names: []string{k8sName(t.jobName)},
+		},
+	}}
+	targetAddr := t.targetAddr
+	sc.RelabelConfigs = append([]*relabelConfig{
+		{
+			Action: "labelmap",
+			Regex:  stringOrList{k8sLabelPrefixes[*k8sRole] + "(.+)"},
+		},
+		{
+			TargetLabel: "__address__",
+			Replacement: &targetAddr,
+		},
+	}, sc.RelabelConfigs...)
+	n := &yaml.Node{}
+	if err := n.Encode(&sc); err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling scrape config: %s", err)
+	}
+	return n
+}
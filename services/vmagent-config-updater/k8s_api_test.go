@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestK8sAPIPodIPs(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: foo
+  targets_count: 300
+  update_interval: 1m
+  update_percent: 10
+  churn:
+    strategy: exact
+    mode: replace
+- job_name: bar
+  targets_count: 300
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	ks := newK8sStore()
+	h := newK8sRequestHandler(ks)
+
+	ks.sync(js.getTargets())
+	ips := getK8sPodIPs(t, h)
+	if len(ips) != 600 {
+		t.Fatalf("unexpected number of pods; got %d; want 600", len(ips))
+	}
+
+	// Replaced pods obtain new IPs, while the remaining pods keep their IPs.
+	js.getTarget("foo").tick(time.Now())
+	ks.sync(js.getTargets())
+	newIPs := getK8sPodIPs(t, h)
+	if len(newIPs) != 600 {
+		t.Fatalf("unexpected number of pods after churn; got %d; want 600", len(newIPs))
+	}
+	kept := 0
+	for pod, ip := range newIPs {
+		if prevIP, ok := ips[pod]; ok {
+			if ip != prevIP {
+				t.Fatalf("unexpected IP change for pod %s from %s to %s", pod, prevIP, ip)
+			}
+			kept++
+		}
+	}
+	if kept != 570 {
+		t.Fatalf("unexpected number of pods kept after churn; got %d; want 570", kept)
+	}
+}
+
+// getK8sPodIPs returns IPs for pods served by h and verifies they are unique.
+func getK8sPodIPs(t *testing.T, h http.Handler) map[string]string {
+	t.Helper()
+	resp := serveRequest(h, "/api/v1/pods", nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	var pl struct {
+		Items []*k8sPod `json:"items"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &pl); err != nil {
+		t.Fatalf("cannot parse pods: %s", err)
+	}
+	ips := make(map[string]string, len(pl.Items))
+	pods := make(map[string]string, len(pl.Items))
+	for _, pod := range pl.Items {
+		ip := pod.Status.PodIP
+		name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+		if prev, ok := pods[ip]; ok {
+			t.Fatalf("duplicate IP %s for pods %s and %s", ip, prev, name)
+		}
+		pods[ip] = name
+		ips[name] = ip
+	}
+	return ips
+}
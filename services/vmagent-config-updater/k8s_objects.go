@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kubernetes objects served by the fake Kubernetes API. They contain only the fields used by Prometheus-compatible service discovery.
+//
+// See https://kubernetes.io/docs/reference/kubernetes-api/
+
+type k8sObjectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace,omitempty"`
+	UID               string            `json:"uid"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	OwnerReferences   []k8sOwnerRef     `json:"ownerReferences,omitempty"`
+	CreationTimestamp string            `json:"creationTimestamp"`
+}
+
+type k8sOwnerRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller bool   `json:"controller"`
+}
+
+type k8sPod struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   k8sObjectMeta `json:"metadata"`
+	Spec       k8sPodSpec    `json:"spec"`
+	Status     k8sPodStatus  `json:"status"`
+}
+
+type k8sPodSpec struct {
+	NodeName   string         `json:"nodeName"`
+	Containers []k8sContainer `json:"containers"`
+}
+
+type k8sContainer struct {
+	Name  string             `json:"name"`
+	Image string             `json:"image"`
+	Ports []k8sContainerPort `json:"ports"`
+}
+
+type k8sContainerPort struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type k8sPodStatus struct {
+	Phase             string               `json:"phase"`
+	PodIP             string               `json:"podIP"`
+	HostIP            string               `json:"hostIP"`
+	Conditions        []k8sCondition       `json:"conditions"`
+	ContainerStatuses []k8sContainerStatus `json:"containerStatuses"`
+}
+
+type k8sCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+type k8sContainerStatus struct {
+	Name         string `json:"name"`
+	Ready        bool   `json:"ready"`
+	RestartCount int    `json:"restartCount"`
+	Image        string `json:"image"`
+	ContainerID  string `json:"containerID"`
+}
+
+type k8sService struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   k8sObjectMeta  `json:"metadata"`
+	Spec       k8sServiceSpec `json:"spec"`
+}
+
+type k8sServiceSpec struct {
+	Type      string            `json:"type"`
+	ClusterIP string            `json:"clusterIP"`
+	Selector  map[string]string `json:"selector,omitempty"`
+	Ports     []k8sServicePort  `json:"ports"`
+}
+
+type k8sServicePort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type k8sEndpoints struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   k8sObjectMeta       `json:"metadata"`
+	Subsets    []k8sEndpointSubset `json:"subsets,omitempty"`
+}
+
+type k8sEndpointSubset struct {
+	Addresses []k8sEndpointAddress `json:"addresses"`
+	Ports     []k8sServicePort     `json:"ports"`
+}
+
+type k8sEndpointAddress struct {
+	IP        string       `json:"ip"`
+	NodeName  string       `json:"nodeName"`
+	TargetRef k8sObjectRef `json:"targetRef"`
+}
+
+type k8sObjectRef struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
+}
+
+type k8sEndpointSlice struct {
+	APIVersion  string             `json:"apiVersion"`
+	Kind        string             `json:"kind"`
+	Metadata    k8sObjectMeta      `json:"metadata"`
+	AddressType string             `json:"addressType"`
+	Endpoints   []k8sSliceEndpoint `json:"endpoints"`
+	Ports       []k8sServicePort   `json:"ports"`
+}
+
+type k8sSliceEndpoint struct {
+	Addresses  []string              `json:"addresses"`
+	Conditions k8sEndpointConditions `json:"conditions"`
+	NodeName   string                `json:"nodeName"`
+	TargetRef  k8sObjectRef          `json:"targetRef"`
+}
+
+type k8sEndpointConditions struct {
+	Ready bool `json:"ready"`
+}
+
+type k8sNode struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   k8sObjectMeta `json:"metadata"`
+	Status     k8sNodeStatus `json:"status"`
+}
+
+type k8sNodeStatus struct {
+	Addresses       []k8sNodeAddress      `json:"addresses"`
+	Conditions      []k8sCondition        `json:"conditions"`
+	DaemonEndpoints k8sNodeDaemonEndpoint `json:"daemonEndpoints"`
+}
+
+type k8sNodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+type k8sNodeDaemonEndpoint struct {
+	KubeletEndpoint struct {
+		Port int `json:"Port"`
+	} `json:"kubeletEndpoint"`
+}
+
+// k8sCreationTimestamp is used for all the objects, since Prometheus-compatible service discovery doesn't use it.
+const k8sCreationTimestamp = "2024-01-01T00:00:00Z"
+
+// maxEndpointsPerSlice is the maximum number of endpoints per EndpointSlice. It matches the Kubernetes default.
+const maxEndpointsPerSlice = 100
+
+// k8sObjects contains Kubernetes objects per resource name and per `namespace/name` key.
+type k8sObjects map[string]map[string]any
+
+func (objs k8sObjects) add(resource, namespace, name string, obj any) {
+	m := objs[resource]
+	if m == nil {
+		m = make(map[string]any)
+		objs[resource] = m
+	}
+	m[namespace+"/"+name] = obj
+}
+
+var k8sNameRe = regexp.MustCompile(`[^a-z0-9-]`)
+
+// k8sName returns valid Kubernetes object name for s.
+func k8sName(s string) string {
+	name := strings.Trim(k8sNameRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(name) == 0 {
+		return "job"
+	}
+	return name
+}
+
+// buildK8sObjects returns Kubernetes objects for the given targets.
+//
+// Every job is represented by a namespace with the job name. Every target of the job is represented by a pod
+// with the target labels, which is exposed via a service with endpoints and endpoint slices.
+// Pods have only the target labels, so targets discovered via kubernetes_sd_configs have the same labels as static targets.
+// Pods are spread among nodesCount nodes. Pod IPs are allocated via ia, while service IPs are allocated from 172.20.0.0/16.
+//
+// An error is returned if some targets cannot obtain pod IPs. Objects for such targets are omitted from the result.
+func buildK8sObjects(targets []*target, nodesCount int, ia *ipAllocator) (k8sObjects, error) {
+	scss := make([][]*staticConfig, len(targets))
+	jobIDs := make(map[string][]int, len(targets))
+	for i, t := range targets {
+		scs := t.staticConfigs()
+		ids := make([]int, len(scs))
+		for j, sc := range scs {
+			ids[j] = sc.id
+		}
+		scss[i] = scs
+		jobIDs[t.jobName] = ids
+	}
+	err := ia.update(jobIDs)
+
+	objs := make(k8sObjects)
+	nodeName := func(id int) string {
+		return fmt.Sprintf("node-%d", id%nodesCount)
+	}
+	nodeIP := func(id int) string {
+		n := id % nodesCount
+		return fmt.Sprintf("192.168.%d.%d", n/250, n%250+1)
+	}
+	for i := 0; i < nodesCount; i++ {
+		name := nodeName(i)
+		node := &k8sNode{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Metadata: k8sObjectMeta{
+				Name: name,
+				UID:  "node-uid-" + strconv.Itoa(i),
+				Labels: map[string]string{
+					"kubernetes.io/hostname": name,
+					"kubernetes.io/os":       "linux",
+				},
+				CreationTimestamp: k8sCreationTimestamp,
+			},
+			Status: k8sNodeStatus{
+				Addresses: []k8sNodeAddress{
+					{Type: "InternalIP", Address: nodeIP(i)},
+					{Type: "Hostname", Address: name},
+				},
+				Conditions: []k8sCondition{{Type: "Ready", Status: "True"}},
+			},
+		}
+		node.Status.DaemonEndpoints.KubeletEndpoint.Port = 10250
+		objs.add("nodes", "", name, node)
+	}
+
+	for i, t := range targets {
+		blockIdx := ia.blockIndex(t.jobName)
+		if blockIdx < 0 {
+			continue
+		}
+		ns := k8sName(t.jobName)
+		svcUID := fmt.Sprintf("svc-uid-%s", ns)
+		scs := scss[i]
+		port := 80
+		if len(scs) > 0 {
+			port = k8sTargetPort(scs[0].Targets[0])
+		}
+		ports := []k8sServicePort{{Name: "http-metrics", Port: port, Protocol: "TCP"}}
+		objs.add("services", ns, ns, &k8sService{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Metadata: k8sObjectMeta{
+				Name:              ns,
+				Namespace:         ns,
+				UID:               svcUID,
+				Labels:            map[string]string{"app": ns},
+				CreationTimestamp: k8sCreationTimestamp,
+			},
+			Spec: k8sServiceSpec{
+				Type:      "ClusterIP",
+				ClusterIP: fmt.Sprintf("172.20.%d.1", blockIdx),
+				Ports:     ports,
+			},
+		})
+
+		var addrs []k8sEndpointAddress
+		var sliceEndpoints []k8sSliceEndpoint
+		for _, sc := range scs {
+			podIP := ia.ip(t.jobName, sc.id)
+			if len(podIP) == 0 {
+				continue
+			}
+			podName := fmt.Sprintf("%s-%d", ns, sc.id)
+			podUID := fmt.Sprintf("pod-uid-%s-%d", ns, sc.id)
+			objs.add("pods", ns, podName, &k8sPod{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Metadata: k8sObjectMeta{
+					Name:              podName,
+					Namespace:         ns,
+					UID:               podUID,
+					Labels:            sc.Labels,
+					CreationTimestamp: k8sCreationTimestamp,
+				},
+				Spec: k8sPodSpec{
+					NodeName: nodeName(sc.id),
+					Containers: []k8sContainer{{
+						Name:  "app",
+						Image: "app:latest",
+						Ports: []k8sContainerPort{{Name: "http-metrics", ContainerPort: port, Protocol: "TCP"}},
+					}},
+				},
+				Status: k8sPodStatus{
+					Phase:      "Running",
+					PodIP:      podIP,
+					HostIP:     nodeIP(sc.id),
+					Conditions: []k8sCondition{{Type: "Ready", Status: "True"}},
+					ContainerStatuses: []k8sContainerStatus{{
+						Name:        "app",
+						Ready:       true,
+						Image:       "app:latest",
+						ContainerID: "containerd://" + podUID,
+					}},
+				},
+			})
+			ref := k8sObjectRef{
+				Kind:      "Pod",
+				Name:      podName,
+				Namespace: ns,
+				UID:       podUID,
+			}
+			addrs = append(addrs, k8sEndpointAddress{
+				IP:        podIP,
+				NodeName:  nodeName(sc.id),
+				TargetRef: ref,
+			})
+			sliceEndpoints = append(sliceEndpoints, k8sSliceEndpoint{
+				Addresses:  []string{podIP},
+				Conditions: k8sEndpointConditions{Ready: true},
+				NodeName:   nodeName(sc.id),
+				TargetRef:  ref,
+			})
+		}
+
+		endpointsMeta := k8sObjectMeta{
+			Name:              ns,
+			Namespace:         ns,
+			UID:               "endpoints-uid-" + ns,
+			Labels:            map[string]string{"app": ns},
+			CreationTimestamp: k8sCreationTimestamp,
+		}
+		eps := &k8sEndpoints{
+			APIVersion: "v1",
+			Kind:       "Endpoints",
+			Metadata:   endpointsMeta,
+		}
+		if len(addrs) > 0 {
+			eps.Subsets = []k8sEndpointSubset{{Addresses: addrs, Ports: ports}}
+		}
+		objs.add("endpoints", ns, ns, eps)
+
+		// Split endpoints into slices in the same way as Kubernetes does by default.
+		for i := 0; i == 0 || i*maxEndpointsPerSlice < len(sliceEndpoints); i++ {
+			name := fmt.Sprintf("%s-%d", ns, i)
+			endpoints := sliceEndpoints[min(i*maxEndpointsPerSlice, len(sliceEndpoints)):min((i+1)*maxEndpointsPerSlice, len(sliceEndpoints))]
+			objs.add("endpointslices", ns, name, &k8sEndpointSlice{
+				APIVersion: "discovery.k8s.io/v1",
+				Kind:       "EndpointSlice",
+				Metadata: k8sObjectMeta{
+					Name:      name,
+					Namespace: ns,
+					UID:       "endpointslice-uid-" + name,
+					Labels: map[string]string{
+						"app":                        ns,
+						"kubernetes.io/service-name": ns,
+					},
+					OwnerReferences: []k8sOwnerRef{{
+						APIVersion: "v1",
+						Kind:       "Service",
+						Name:       ns,
+						UID:        svcUID,
+						Controller: true,
+					}},
+					CreationTimestamp: k8sCreationTimestamp,
+				},
+				AddressType: "IPv4",
+				Endpoints:   append([]k8sSliceEndpoint{}, endpoints...),
+				Ports:       ports,
+			})
+		}
+	}
+	return objs, err
+}
+
+// k8sTargetPort returns port for the given target address.
+func k8sTargetPort(addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 80
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 80
+	}
+	return port
+}
+
+// k8sObjectMetadata returns metadata for the given Kubernetes object.
+func k8sObjectMetadata(obj any) *k8sObjectMeta {
+	switch o := obj.(type) {
+	case *k8sPod:
+		return &o.Metadata
+	case *k8sService:
+		return &o.Metadata
+	case *k8sEndpoints:
+		return &o.Metadata
+	case *k8sEndpointSlice:
+		return &o.Metadata
+	case *k8sNode:
+		return &o.Metadata
+	default:
+		panic(fmt.Errorf("BUG: unexpected Kubernetes object type %T", obj))
+	}
+}
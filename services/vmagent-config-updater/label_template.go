@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var targetLabels = newArrayFlag("targetLabels", "", "Optional ';'-delimited list of extra `name=template` labels for every target, "+
+	"e.g. 'team={{ .Pick \"a\" \"b\" }};shard={{ bucket 16 .Index }}'. Commas and semicolons inside templates must be escaped with backslash. "+
+	"See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#label-templates")
+
+var labelDistribution = newArrayFlag("labelDistribution", "uniform", "Distribution of targets among label values picked via .Pick and .PickIndex at -targetLabels "+
+	"and among deployments for -topologyNamespaces. Supported values: uniform, zipf:<exponent>, normal:<stddev>. "+
+	"See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#skewed-distributions")
+
+// parseTargetLabelsFlag parses `name=template` pairs delimited by `;` from -targetLabels.
+//
+// Semicolons inside templates must be escaped as `\;`.
+func parseTargetLabelsFlag(s string) (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, kv := range splitFlagValues(s, ';') {
+		name, tmpl, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing `=` in %q; expecting `name=template`", kv)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("duplicate template for label %q", name)
+		}
+		m[name] = tmpl
+	}
+	return m, nil
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelTemplateFuncs contains functions available in label templates.
+var labelTemplateFuncs = template.FuncMap{
+	// pad returns v padded with leading zeros up to n digits.
+	"pad": func(n, v int) string {
+		return fmt.Sprintf("%0*d", n, v)
+	},
+	// bucket returns hash bucket in the range [0..n) for v.
+	"bucket": func(n int, v any) (int, error) {
+		if n <= 0 {
+			return 0, fmt.Errorf("the number of buckets must be positive; got %d", n)
+		}
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%v", v)
+		return int(h.Sum64() % uint64(n)), nil
+	},
+	// repeat returns s repeated n times. It can be used for generating long label values.
+	"repeat": func(s string, n int) (string, error) {
+		if n < 0 {
+			return "", fmt.Errorf("the number of repeats cannot be negative; got %d", n)
+		}
+		return strings.Repeat(s, n), nil
+	},
+}
+
+// labelTemplateData is passed to label templates for every target.
+type labelTemplateData struct {
+	// Index is the unique id of the target within the job.
+	Index int
+
+	// Job is the job name.
+	Job string
+
+	// Revision is the revision when the target obtained its current labels.
+	Revision int
+
+	seed uint64
+	dist *distribution
+}
+
+// Pick returns pseudo-random value from values according to d.dist. The value doesn't change during the target lifetime.
+func (d *labelTemplateData) Pick(values ...string) (string, error) {
+	if len(values) == 0 {
+		return "", fmt.Errorf("Pick requires at least a single value")
+	}
+	return values[d.pick(len(values))], nil
+}
+
+// PickIndex returns pseudo-random number in the range [0..n) according to d.dist. The value doesn't change during the target lifetime.
+func (d *labelTemplateData) PickIndex(n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("PickIndex requires positive number; got %d", n)
+	}
+	return d.pick(n), nil
+}
+
+func (d *labelTemplateData) pick(n int) int {
+	if d.dist == nil {
+		return int(randUint64(d.seed, -7, d.Index) % uint64(n))
+	}
+	return d.dist.pick(randFloat64(d.seed, -7, d.Index), n)
+}
+
+// RandString returns pseudo-random string with n hex chars. The value doesn't change during the target lifetime.
+func (d *labelTemplateData) RandString(n int) (string, error) {
+	if n < 0 {
+		return "", fmt.Errorf("RandString length cannot be negative; got %d", n)
+	}
+	var sb strings.Builder
+	for i := 0; sb.Len() < n; i++ {
+		fmt.Fprintf(&sb, "%016x", randUint64(d.seed, -8-i, d.Index))
+	}
+	return sb.String()[:n], nil
+}
+
+// labelTemplates contains parsed templates for extra target labels.
+type labelTemplates struct {
+	src       map[string]string
+	names     []string
+	templates []*template.Template
+}
+
+// parseLabelTemplates parses label templates from m. It returns nil if m is empty.
+func parseLabelTemplates(m map[string]string) (*labelTemplates, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	lt := &labelTemplates{
+		src:   m,
+		names: sortedKeys(m),
+	}
+	for _, name := range lt.names {
+		if !labelNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid label name %q; it must match %s", name, labelNameRe)
+		}
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q; label names starting with `__` are reserved for internal use", name)
+		}
+		tmpl, err := template.New(name).Funcs(labelTemplateFuncs).Option("missingkey=error").Parse(m[name])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse template for label %q: %w", name, err)
+		}
+		lt.templates = append(lt.templates, tmpl)
+	}
+	return lt, nil
+}
+
+// equal returns true if lt is built from m.
+func (lt *labelTemplates) equal(m map[string]string) bool {
+	if lt == nil {
+		return len(m) == 0
+	}
+	return maps.Equal(lt.src, m)
+}
+
+// apply sets labels for sc according to lt. Values for .Pick and .PickIndex are selected according to dist.
+func (lt *labelTemplates) apply(sc *staticConfig, job string, seed uint64, dist *distribution) error {
+	if lt == nil {
+		return nil
+	}
+	d := &labelTemplateData{
+		Index:    sc.id,
+		Job:      job,
+		Revision: sc.rev,
+		seed:     seed,
+		dist:     dist,
+	}
+	var sb strings.Builder
+	for i, tmpl := range lt.templates {
+		sb.Reset()
+		if err := tmpl.Execute(&sb, d); err != nil {
+			return fmt.Errorf("cannot execute template for label %q: %w", lt.names[i], err)
+		}
+		sc.Labels[lt.names[i]] = sb.String()
+	}
+	return nil
+}
+
+// validateLabelTemplates verifies label templates at m for the given job.
+//
+// Templates cannot set reserved labels, since these labels are changed by churn.
+func validateLabelTemplates(m map[string]string, job string, reserved []string) error {
+	for _, name := range reserved {
+		if _, ok := m[name]; ok {
+			return fmt.Errorf("label %q cannot be set via templates, since it is generated by vmagent-config-updater", name)
+		}
+	}
+	lt, err := parseLabelTemplates(m)
+	if err != nil {
+		return err
+	}
+	return lt.apply(newStaticConfig("", "instance", 0, 0), job, 0, nil)
+}
+
+// applyLabelTemplatesLocked sets extra labels for sc according to t.labelTemplates.
+//
+// It must be called under t.mu.
+func (t *target) applyLabelTemplatesLocked(sc *staticConfig) {
+	if err := t.labelTemplates.apply(sc, t.jobName, t.seed, t.labelDist); err != nil {
+		// Templates are validated before updating the target, so runtime errors may be caused only by template data.
+		log.Printf("cannot apply label templates for job %q: %s", t.jobName, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetLabelsFlag(t *testing.T) {
+	f := func(s string, want map[string]string) {
+		t.Helper()
+		m, err := parseTargetLabelsFlag(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Fatalf("unexpected labels for %q; got %q; want %q", s, m, want)
+		}
+	}
+	f("", nil)
+	f("team=a;shard={{ bucket 16 .Index }}", map[string]string{
+		"team":  "a",
+		"shard": "{{ bucket 16 .Index }}",
+	})
+
+	// Escaped semicolons are kept inside templates.
+	f(`team={{ .Pick "a\;b" "c" }};path=x\;y=z`, map[string]string{
+		"team": `{{ .Pick "a;b" "c" }}`,
+		"path": "x;y=z",
+	})
+
+	// Escaped commas are unescaped by the flag parser, while escaped semicolons are passed to parseTargetLabelsFlag.
+	vs := splitFlagValues(`team={{ .Pick "a\,b" "c\;d" }},team=x`, ',')
+	if len(vs) != 2 {
+		t.Fatalf("unexpected number of flag values; got %d; want 2", len(vs))
+	}
+	f(vs[0], map[string]string{
+		"team": `{{ .Pick "a,b" "c;d" }}`,
+	})
+
+	for _, s := range []string{"team", "team=a;team=b"} {
+		if _, err := parseTargetLabelsFlag(s); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+}
+
+func TestLabelTemplatesValidation(t *testing.T) {
+	f := func(labels, topology, wantErr string) {
+		t.Helper()
+		_, err := parseJobConfigs([]byte(`
+jobs:
+- job_name: foo
+  targets_count: 10
+  labels:
+` + labels + topology))
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("unexpected error for labels %q; got %v; want error containing %q", labels, err, wantErr)
+		}
+	}
+	f("    __name__: foo\n", "", "label names starting with `__` are reserved")
+	f("    __meta_foo: foo\n", "", "label names starting with `__` are reserved")
+	f("    instance: foo\n", "", `label "instance" cannot be set via templates`)
+	f("    revision: foo\n", "", `label "revision" cannot be set via templates`)
+	f("    pod: foo\n", "  topology:\n    namespaces: 1\n", `label "pod" cannot be set via templates`)
+	f("    1foo: foo\n", "", "invalid label name")
+	f("    foo: '{{ .Missing }}'\n", "", `cannot execute template for label "foo"`)
+}
+
+func TestLabelTemplatesReload(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: labels_job
+  targets_count: 3
+  labels:
+    team: 'team-{{ .Index }}'
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	checkLabel := func(name, prefix string) {
+		t.Helper()
+		resp := serveRequest(h, "/api/v1/sd/labels_job", nil)
+		var scs []*staticConfig
+		if err := json.Unmarshal(resp.Body.Bytes(), &scs); err != nil {
+			t.Fatalf("cannot parse http_sd response: %s", err)
+		}
+		for _, sc := range scs {
+			if v := sc.Labels[name]; !strings.HasPrefix(v, prefix) {
+				t.Fatalf("unexpected value for label %q at %s; got %q; want prefix %q", name, sc.Labels["instance"], v, prefix)
+			}
+		}
+	}
+	checkLabel("team", "team-")
+	eventsCount := len(churnEvents.getEvents("labels_job", *churnLogSize))
+
+	// Changed templates are registered as relabeled targets at the next revision.
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: labels_job
+  targets_count: 3
+  labels:
+    team: 'squad-{{ .Index }}'
+`)
+	checkLabel("team", "squad-")
+	events := churnEvents.getEvents("labels_job", *churnLogSize)
+	if len(events) != eventsCount+1 {
+		t.Fatalf("unexpected number of churn events; got %d; want %d", len(events), eventsCount+1)
+	}
+	if ev := events[len(events)-1]; ev.Revision != 1 || len(ev.Relabeled) != 3 {
+		t.Fatalf("unexpected churn event; got revision %d with %d relabeled targets; want revision 1 with 3 relabeled targets", ev.Revision, len(ev.Relabeled))
+	}
+	if resp := serveRequest(h, "/api/v1/config/diff?job=labels_job&from=0", nil); resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for config diff; got %d; want %d", resp.Code, http.StatusOK)
+	}
+
+	// Re-applying the same templates doesn't generate churn.
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: labels_job
+  targets_count: 3
+  labels:
+    team: 'squad-{{ .Index }}'
+`)
+	if n := len(churnEvents.getEvents("labels_job", *churnLogSize)); n != eventsCount+1 {
+		t.Fatalf("unexpected number of churn events after reloading the same config; got %d; want %d", n, eventsCount+1)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	loadProfileType = newArrayFlag("loadProfile", "", "Optional profile for changing the number of targets over time. Supported values: ramp, step, spike. "+
+		"See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#load-profiles")
+	loadProfileFinalTargets  = newArrayFlag("loadProfileFinalTargets", 0, "The final number of targets for -loadProfile=ramp and -loadProfile=step")
+	loadProfileDuration      = newArrayFlag("loadProfileDuration", time.Duration(0), "The duration for reaching -loadProfileFinalTargets from -targetsCount for -loadProfile=ramp")
+	loadProfileStepInterval  = newArrayFlag("loadProfileStepInterval", time.Duration(0), "Interval between steps for -loadProfile=step")
+	loadProfileStepTargets   = newArrayFlag("loadProfileStepTargets", 0, "The number of targets to add at every step for -loadProfile=step")
+	loadProfileSpikeDelay    = newArrayFlag("loadProfileSpikeDelay", time.Duration(0), "The delay before the spike for -loadProfile=spike")
+	loadProfileSpikeDuration = newArrayFlag("loadProfileSpikeDuration", time.Duration(0), "The duration of the spike for -loadProfile=spike")
+	loadProfileSpikeTargets  = newArrayFlag("loadProfileSpikeTargets", 0, "The number of targets during the spike for -loadProfile=spike")
+
+	loadProfileCheckInterval = flag.Duration("loadProfileCheckInterval", 10*time.Second, "How often to adjust the number of targets according to -loadProfile")
+)
+
+// initLoadProfile validates -loadProfileCheckInterval.
+func initLoadProfile() {
+	if *loadProfileCheckInterval <= 0 {
+		log.Fatalf("-loadProfileCheckInterval must be positive; got %s", *loadProfileCheckInterval)
+	}
+}
+
+// loadProfileConfig describes how the number of targets changes over time since the job start.
+type loadProfileConfig struct {
+	Type          string        `yaml:"type,omitempty"`
+	FinalTargets  int           `yaml:"final_targets,omitempty"`
+	Duration      time.Duration `yaml:"duration,omitempty"`
+	StepInterval  time.Duration `yaml:"step_interval,omitempty"`
+	StepTargets   int           `yaml:"step_targets,omitempty"`
+	SpikeDelay    time.Duration `yaml:"spike_delay,omitempty"`
+	SpikeDuration time.Duration `yaml:"spike_duration,omitempty"`
+	SpikeTargets  int           `yaml:"spike_targets,omitempty"`
+}
+
+// loadProfileConfigFromFlags returns loadProfileConfig from command-line flags for the job with the given idx.
+func loadProfileConfigFromFlags(idx int) loadProfileConfig {
+	return loadProfileConfig{
+		Type:          loadProfileType.getArg(idx),
+		FinalTargets:  loadProfileFinalTargets.getArg(idx),
+		Duration:      loadProfileDuration.getArg(idx),
+		StepInterval:  loadProfileStepInterval.getArg(idx),
+		StepTargets:   loadProfileStepTargets.getArg(idx),
+		SpikeDelay:    loadProfileSpikeDelay.getArg(idx),
+		SpikeDuration: loadProfileSpikeDuration.getArg(idx),
+		SpikeTargets:  loadProfileSpikeTargets.getArg(idx),
+	}
+}
+
+func (lp *loadProfileConfig) isSet() bool {
+	return len(lp.Type) > 0
+}
+
+func (lp *loadProfileConfig) validate() error {
+	switch lp.Type {
+	case "":
+		return nil
+	case "ramp":
+		if lp.FinalTargets <= 0 {
+			return fmt.Errorf("`final_targets` must be positive for `type: ramp`")
+		}
+		if lp.Duration <= 0 {
+			return fmt.Errorf("`duration` must be positive for `type: ramp`")
+		}
+	case "step":
+		if lp.FinalTargets <= 0 {
+			return fmt.Errorf("`final_targets` must be positive for `type: step`")
+		}
+		if lp.StepInterval <= 0 {
+			return fmt.Errorf("`step_interval` must be positive for `type: step`")
+		}
+		if lp.StepTargets == 0 {
+			return fmt.Errorf("`step_targets` cannot be zero for `type: step`")
+		}
+	case "spike":
+		if lp.SpikeDelay < 0 {
+			return fmt.Errorf("`spike_delay` cannot be negative for `type: spike`")
+		}
+		if lp.SpikeDuration <= 0 {
+			return fmt.Errorf("`spike_duration` must be positive for `type: spike`")
+		}
+		if lp.SpikeTargets <= 0 {
+			return fmt.Errorf("`spike_targets` must be positive for `type: spike`")
+		}
+	default:
+		return fmt.Errorf("unsupported load profile `type: %s`; supported values: ramp, step, spike", lp.Type)
+	}
+	return nil
+}
+
+// targetsAt returns the number of targets at the given elapsed time since the job start,
+// when the job starts with initialTargets targets.
+func (lp *loadProfileConfig) targetsAt(initialTargets int, elapsed time.Duration) int {
+	switch lp.Type {
+	case "ramp":
+		if elapsed >= lp.Duration {
+			return lp.FinalTargets
+		}
+		return initialTargets + int(float64(lp.FinalTargets-initialTargets)*float64(elapsed)/float64(lp.Duration))
+	case "step":
+		n := initialTargets + int(elapsed/lp.StepInterval)*lp.StepTargets
+		if lp.StepTargets > 0 {
+			return min(n, lp.FinalTargets)
+		}
+		return max(n, lp.FinalTargets)
+	case "spike":
+		if elapsed >= lp.SpikeDelay && elapsed < lp.SpikeDelay+lp.SpikeDuration {
+			return lp.SpikeTargets
+		}
+		return initialTargets
+	default:
+		return initialTargets
+	}
+}
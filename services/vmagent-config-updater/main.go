@@ -2,14 +2,17 @@ package main
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -19,8 +22,11 @@ func parseFlagValue[T cmp.Ordered | bool](v string, defaultValue T) (any, error)
 	var err error
 	value := defaultValue
 	if len(v) > 0 {
-		if _, ok := any(value).(time.Duration); ok {
+		switch any(value).(type) {
+		case time.Duration:
 			return time.ParseDuration(v)
+		case string:
+			return v, nil
 		}
 		_, err = fmt.Sscanf(v, "%v", &value)
 	}
@@ -28,10 +34,28 @@ func parseFlagValue[T cmp.Ordered | bool](v string, defaultValue T) (any, error)
 }
 
 type arrayFlag[T cmp.Ordered | bool] struct {
+	name         string
 	values       []T
 	defaultValue T
 }
 
+// perJobFlag is implemented by arrayFlag and allows checking per-job flags regardless of their type.
+type perJobFlag interface {
+	flagName() string
+	valuesCount() int
+}
+
+// perJobFlags contains all the flags registered via newArrayFlag.
+var perJobFlags []perJobFlag
+
+func (af *arrayFlag[T]) flagName() string {
+	return af.name
+}
+
+func (af *arrayFlag[T]) valuesCount() int {
+	return len(af.values)
+}
+
 func (af *arrayFlag[T]) String() string {
 	if len(af.values) > 0 {
 		strVals := make([]string, len(af.values))
@@ -44,9 +68,9 @@ func (af *arrayFlag[T]) String() string {
 }
 
 func (af *arrayFlag[T]) Set(value string) error {
-	for _, v := range strings.Split(value, ",") {
+	for _, v := range splitFlagValues(value, ',') {
 		if val, err := parseFlagValue(v, af.defaultValue); err != nil {
-			return fmt.Errorf("failed to parse value %v for type %t", val)
+			return fmt.Errorf("failed to parse value %q for type %T: %w", v, af.defaultValue, err)
 		} else {
 			af.values = append(af.values, val.(T))
 		}
@@ -54,6 +78,25 @@ func (af *arrayFlag[T]) Set(value string) error {
 	return nil
 }
 
+// splitFlagValues splits s by sep except of separators escaped with backslash.
+func splitFlagValues(s string, sep byte) []string {
+	var values []string
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			sb.WriteByte(sep)
+			i++
+		case s[i] == sep:
+			values = append(values, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return append(values, sb.String())
+}
+
 func (af *arrayFlag[T]) total() []T {
 	if len(af.values) == 0 {
 		return []T{af.defaultValue}
@@ -61,19 +104,31 @@ func (af *arrayFlag[T]) total() []T {
 	return af.values
 }
 
+// getArg returns the value for the job with the given idx.
+//
+// A single value is applied to all the jobs. See validatePerJobFlags.
 func (af *arrayFlag[T]) getArg(idx int) T {
-	if len(af.values) == 0 || idx >= len(af.values) {
+	switch {
+	case len(af.values) == 0:
 		return af.defaultValue
+	case len(af.values) == 1:
+		return af.values[0]
+	case idx >= len(af.values):
+		return af.defaultValue
+	default:
+		return af.values[idx]
 	}
-	return af.values[idx]
 }
 
 func newArrayFlag[T cmp.Ordered | bool](name string, defaultValue T, description string) *arrayFlag[T] {
-	description += "\nSupports an `array` of values separated by comma or specified via multiple flags."
+	description += "\nSupports an `array` of values separated by comma or specified via multiple flags. Commas inside values must be escaped with backslash. " +
+		"The number of values must match the number of -jobName values. A single value is applied to all the jobs."
 	a := &arrayFlag[T]{
+		name:         name,
 		defaultValue: defaultValue,
 	}
 	flag.Var(a, name, description)
+	perJobFlags = append(perJobFlags, a)
 	return a
 }
 
@@ -87,7 +142,8 @@ var (
 	scrapeInterval             = newArrayFlag("scrapeInterval", time.Second*5, "The scrape_interval to set at the scrape config returned from -httpListenAddr")
 	scrapeConfigUpdateInterval = newArrayFlag("scrapeConfigUpdateInterval", time.Minute*10, "The -scrapeConfigUpdatePercent scrape targets are updated in the scrape config returned from -httpListenAddr every -scrapeConfigUpdateInterval")
 	scrapeConfigUpdatePercent  = newArrayFlag("scrapeConfigUpdatePercent", 1.0, "The -scrapeConfigUpdatePercent scrape targets are updated in the scrape config returned from -httpListenAddr ever -scrapeConfigUpdateInterval")
-	scrapeConfigMetricRelabel  = newArrayFlag("scrapeConfigMetricRelabel", "", "Path to metric relabel configuration for scrape targets")
+	scrapeConfigMetricRelabel  = newArrayFlag("scrapeConfigMetricRelabel", "", "Path to metric_relabel_configs for scrape targets")
+	scrapeConfigRelabel        = newArrayFlag("scrapeConfigRelabel", "", "Path to relabel_configs for scrape targets")
 )
 
 func main() {
@@ -95,121 +151,85 @@ func main() {
 	flag.VisitAll(func(f *flag.Flag) {
 		log.Printf("-%s=%s", f.Name, f.Value.String())
 	})
-	uniqueJobs := make(map[string]struct{})
-	for _, job := range jobName.total() {
-		uniqueJobs[job] = struct{}{}
-	}
-
-	log.Printf("creating %d jobs", len(uniqueJobs))
-	targets := make([]*target, len(uniqueJobs))
-	c := &config{
-		ScrapeConfigs: make([]*yaml.Node, len(targets)),
-	}
-	for i := range targets {
-		targets[i] = &target{
-			config: newScrapeConfig(
-				targetsCount.getArg(i),
-				scrapeInterval.getArg(i),
-				targetAddr.getArg(i),
-				labelName.getArg(i),
-				jobName.getArg(i),
-				scrapeConfigMetricRelabel.getArg(i),
-				targetRequiresK8sAuth.getArg(i),
-			),
-			updateInterval: scrapeConfigUpdateInterval.getArg(i),
-			updatePercent:  scrapeConfigUpdatePercent.getArg(i) / 100,
-		}
-		go targets[i].run()
+	initFileSD()
+	initLoadProfile()
+	initPrometheusConfig()
+	initK8sAPI()
+	initState()
+	initRandomSeed()
+	jcs, err := loadJobConfigs()
+	if err != nil {
+		log.Fatalf("cannot load job configs: %s", err)
 	}
-	rh := func(w http.ResponseWriter, r *http.Request) {
-		for i := range targets {
-			c.ScrapeConfigs[i] = targets[i].marshal()
-		}
-		data := c.marshalYAML()
-		w.Header().Set("Content-Type", "text/yaml")
-		w.Write(data)
+	sc, err := loadScenario(jcs)
+	if err != nil {
+		log.Fatalf("cannot load scenario: %s", err)
 	}
-	hf := http.HandlerFunc(rh)
-	log.Printf("starting scrape config updater at http://%s/", *listenAddr)
-	if err := http.ListenAndServe(*listenAddr, hf); err != nil {
-		log.Fatalf("unexpected error when running the http server: %s", err)
+	log.Printf("creating %d jobs", len(jcs))
+	js := &jobs{}
+	if err := js.update(jcs); err != nil {
+		log.Fatalf("cannot start jobs: %s", err)
 	}
-}
-
-func (c *config) marshalYAML() []byte {
-	data, err := yaml.Marshal(c)
-	if err != nil {
-		log.Fatalf("BUG: unexpected error when marshaling config: %s", err)
+	if sc != nil {
+		go runScenario(js, sc)
 	}
-	return data
-}
-
-func newScrapeConfig(targetsCount int, scrapeInterval time.Duration, targetAddr, labelName, jobName, metricRelabel string, requiresK8sAuth bool) *scrapeConfig {
-	scs := make([]*staticConfig, 0, targetsCount)
-	for i := 0; i < targetsCount; i++ {
-		scs = append(scs, &staticConfig{
-			Targets: []string{targetAddr},
-			Labels: map[string]string{
-				labelName:  fmt.Sprintf("%s-%d", labelName, i),
-				"revision": "r0",
-			},
-		})
-	}
-	var mrc []*metricRelabelConfig
-	if len(metricRelabel) > 0 {
-		if data, err := os.ReadFile(metricRelabel); err != nil {
-			log.Fatalf("failed to open %q metric relabel config file: %v", metricRelabel, err)
-		} else if err := yaml.Unmarshal(data, &mrc); err != nil {
-			log.Fatalf("failed to parse %q metric relabel config: %v", metricRelabel, err)
-		}
+	stopCh := make(chan struct{})
+	var flusherWG sync.WaitGroup
+	if len(*stateFile) > 0 {
+		flusherWG.Add(1)
+		go func() {
+			defer flusherWG.Done()
+			runStateFlusher(js, stopCh)
+		}()
+	}
+	if len(*k8sAPIListenAddr) > 0 {
+		go runK8sAPI(js)
 	}
-	var hc *httpConfig
-	if requiresK8sAuth {
-		hc = &httpConfig{
-			BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+	if len(*consulListenAddr) > 0 {
+		go runConsulAPI(js)
+	}
+	if len(*configPath) > 0 {
+		go js.watchConfig()
+	}
+	setReady()
+	log.Printf("starting scrape config updater at http://%s/", *listenAddr)
+	srv := &http.Server{
+		Addr:    *listenAddr,
+		Handler: newRequestHandler(js),
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("unexpected error when running the http server: %s", err)
 		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("received %s; shutting down", sig)
+
+	// Stop serving configs before the final state flush, so agents don't obtain changes, which aren't persisted.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("cannot gracefully stop the http server: %s", err)
 	}
-	return &scrapeConfig{
-		JobName:              jobName,
-		ScrapeInterval:       scrapeInterval,
-		HTTPConfig:           hc,
-		StaticConfigs:        scs,
-		MetricRelabelConfigs: mrc,
-	}
-}
-
-type target struct {
-	config         *scrapeConfig
-	updatePercent  float64
-	updateInterval time.Duration
-	mu             sync.Mutex
-}
-
-func (t *target) run() {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	rev := 0
-	for range time.Tick(t.updateInterval) {
-		rev++
-		revStr := fmt.Sprintf("r%d", rev)
-		t.mu.Lock()
-		for _, sc := range t.config.StaticConfigs {
-			if r.Float64() >= t.updatePercent {
-				continue
-			}
-			sc.Labels["revision"] = revStr
+	close(stopCh)
+	flusherWG.Wait()
+	if len(*stateFile) > 0 {
+		if err := flushState(js); err != nil {
+			log.Fatalf("cannot flush state on %s: %s", sig, err)
 		}
-		t.mu.Unlock()
+		log.Printf("flushed state to -stateFile=%q", *stateFile)
 	}
 }
 
-func (t *target) marshal() *yaml.Node {
-	n := &yaml.Node{}
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if err := n.Encode(t.config); err != nil {
-		log.Fatalf("BUG: unexpected error when marshaling scrape config: %s", err)
+func (c *config) marshalYAML() []byte {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling config: %s", err)
 	}
-	return n
+	return data
 }
 
 // config represents essential parts from Prometheus config defined at https://prometheus.io/docs/prometheus/latest/configuration/configuration/
@@ -217,38 +237,44 @@ type config struct {
 	ScrapeConfigs []*yaml.Node `yaml:"scrape_configs"`
 }
 
-// rapeConfig represents essential parts for `scrape_config` section of Prometheus config.
+// scrapeConfig represents essential parts for `scrape_config` section of Prometheus config.
 //
 // See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config
 type scrapeConfig struct {
-	JobName              string                 `yaml:"job_name"`
-	ScrapeInterval       time.Duration          `yaml:"scrape_interval"`
-	HTTPConfig           *httpConfig            `yaml:",inline"`
-	StaticConfigs        []*staticConfig        `yaml:"static_configs"`
-	MetricRelabelConfigs []*metricRelabelConfig `yaml:"metric_relabel_configs,omitempty"`
-}
-
-// httpConfig represents HTTP configuration for scrape, such as auth params
-type httpConfig struct {
-	BearerTokenFile string `yaml:"bearer_token_file"`
+	JobName              string                `yaml:"job_name"`
+	ScrapeInterval       time.Duration         `yaml:"scrape_interval"`
+	ScrapeTimeout        time.Duration         `yaml:"scrape_timeout,omitempty"`
+	MetricsPath          string                `yaml:"metrics_path,omitempty"`
+	Params               map[string][]string   `yaml:"params,omitempty"`
+	Scheme               string                `yaml:"scheme,omitempty"`
+	HonorLabels          bool                  `yaml:"honor_labels,omitempty"`
+	HonorTimestamps      *bool                 `yaml:"honor_timestamps,omitempty"`
+	SampleLimit          int                   `yaml:"sample_limit,omitempty"`
+	LabelLimit           int                   `yaml:"label_limit,omitempty"`
+	BodySizeLimit        string                `yaml:"body_size_limit,omitempty"`
+	SeriesLimit          int                   `yaml:"series_limit,omitempty"`
+	StreamParse          bool                  `yaml:"stream_parse,omitempty"`
+	ScrapeAlignInterval  time.Duration         `yaml:"scrape_align_interval,omitempty"`
+	HTTPConfig           *httpConfig           `yaml:",inline"`
+	StaticConfigs        []*staticConfig       `yaml:"static_configs,omitempty"`
+	KubernetesSDConfigs  []*kubernetesSDConfig `yaml:"kubernetes_sd_configs,omitempty"`
+	ConsulSDConfigs      []*consulSDConfig     `yaml:"consul_sd_configs,omitempty"`
+	RelabelConfigs       []*relabelConfig      `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []*relabelConfig      `yaml:"metric_relabel_configs,omitempty"`
 }
 
 // staticConfig represents essential parts for `static_config` section of Prometheus config.
 //
+// It is also used as a target group for http_sd_configs responses.
+//
 // See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#static_config
 type staticConfig struct {
-	Targets []string          `yaml:"targets"`
-	Labels  map[string]string `yaml:"labels"`
-}
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
 
-// metricRelabelConfig represents `metric_relabel_configs` section of Prometheus config.
-//
-// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#metric_relabel_configs
-type metricRelabelConfig struct {
-	If          string `yaml:"if,omitempty"`
-	Action      string `yaml:"action,omitempty"`
-	Regex       string `yaml:"regex,omitempty"`
-	Replacement string `yaml:"replacement,omitempty"`
-	TargetLabel string `yaml:"target_label,omitempty"`
-	SourceLabel string `yaml:"source_label,omitempty"`
+	// id is the unique id of the target within the job. It is used in the target label.
+	id int
+
+	// rev is the revision when the target obtained its current labels.
+	rev int
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counter is a monotonically increasing metric.
+type counter struct {
+	n atomic.Uint64
+}
+
+func (c *counter) inc() {
+	c.n.Add(1)
+}
+
+func (c *counter) add(n int) {
+	c.n.Add(uint64(n))
+}
+
+// histogram is a metric with Prometheus-compatible cumulative buckets.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// durationBuckets are upper bounds for buckets of histograms measuring durations in seconds.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+func (h *histogram) update(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) updateDuration(startTime time.Time) {
+	h.update(time.Since(startTime).Seconds())
+}
+
+// metricSet holds metrics exposed at /metrics.
+//
+// Metric names may contain labels in Prometheus text exposition format, e.g. `foo{bar="baz"}`.
+type metricSet struct {
+	mu         sync.Mutex
+	counters   map[string]*counter
+	histograms map[string]*histogram
+}
+
+var metrics = &metricSet{
+	counters:   make(map[string]*counter),
+	histograms: make(map[string]*histogram),
+}
+
+func (ms *metricSet) getOrCreateCounter(name string) *counter {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	c := ms.counters[name]
+	if c == nil {
+		c = &counter{}
+		ms.counters[name] = c
+	}
+	return c
+}
+
+func (ms *metricSet) getOrCreateHistogram(name string) *histogram {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	h := ms.histograms[name]
+	if h == nil {
+		h = &histogram{
+			buckets: durationBuckets,
+			counts:  make([]uint64, len(durationBuckets)),
+		}
+		ms.histograms[name] = h
+	}
+	return h
+}
+
+// writePrometheus writes all the metrics from ms to w in Prometheus text exposition format.
+func (ms *metricSet) writePrometheus(w io.Writer) {
+	ms.mu.Lock()
+	counterNames := sortedKeys(ms.counters)
+	histogramNames := sortedKeys(ms.histograms)
+	ms.mu.Unlock()
+
+	for _, name := range counterNames {
+		fmt.Fprintf(w, "%s %d\n", name, ms.getOrCreateCounter(name).n.Load())
+	}
+	for _, name := range histogramNames {
+		h := ms.getOrCreateHistogram(name)
+		h.mu.Lock()
+		family, labels := metricFamily(name), metricLabels(name)
+		labelsPrefix := ""
+		if len(labels) > 0 {
+			labelsPrefix = labels[1:len(labels)-1] + ","
+		}
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", family, labelsPrefix, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", family, labelsPrefix, h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", family, labels, h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", family, labels, h.count)
+		h.mu.Unlock()
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func metricFamily(name string) string {
+	if n := strings.IndexByte(name, '{'); n >= 0 {
+		return name[:n]
+	}
+	return name
+}
+
+func metricLabels(name string) string {
+	if n := strings.IndexByte(name, '{'); n >= 0 {
+		return name[n:]
+	}
+	return ""
+}
+
+// labelValueEscaper escapes label values according to Prometheus text exposition format.
+//
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-format-details
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// quoteLabelValue returns s as quoted label value for Prometheus text exposition format.
+func quoteLabelValue(s string) string {
+	return `"` + labelValueEscaper.Replace(s) + `"`
+}
+
+// writeGauge writes gauge metric with the given name and value to w in Prometheus text exposition format.
+func writeGauge(w io.Writer, name string, value float64) {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		fmt.Fprintf(w, "%s %d\n", name, int64(value))
+		return
+	}
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+// writeJobsMetrics writes per-job metrics and the current scenario phase for js to w.
+func writeJobsMetrics(w io.Writer, js *jobs) {
+	if p, start := js.getPhase(); p != nil {
+		phase := "{phase=" + quoteLabelValue(p.Name) + "}"
+		writeGauge(w, "vmagent_config_updater_scenario_phase"+phase, 1)
+		writeGauge(w, "vmagent_config_updater_scenario_phase_start_timestamp_seconds"+phase, float64(start.Unix()))
+	}
+	for _, t := range js.getTargets() {
+		st := t.status()
+		job := "{job=" + quoteLabelValue(st.JobName) + "}"
+		writeGauge(w, "vmagent_config_updater_job_revision"+job, float64(st.Revision))
+		writeGauge(w, "vmagent_config_updater_job_targets"+job, float64(st.TargetsCount))
+		writeGauge(w, "vmagent_config_updater_job_update_percent"+job, st.UpdatePercent)
+		writeGauge(w, "vmagent_config_updater_job_next_update_timestamp_seconds"+job, float64(st.NextUpdate.Unix()))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// otelConfig represents OpenTelemetry Collector config with prometheus receiver and prometheusremotewrite exporter.
+//
+// See https://opentelemetry.io/docs/collector/configuration/
+type otelConfig struct {
+	Extensions map[string]any `yaml:"extensions,omitempty"`
+	Receivers  map[string]any `yaml:"receivers"`
+	Exporters  map[string]any `yaml:"exporters"`
+	Service    otelService    `yaml:"service"`
+}
+
+type otelService struct {
+	Extensions []string                `yaml:"extensions,omitempty"`
+	Pipelines  map[string]otelPipeline `yaml:"pipelines"`
+}
+
+type otelPipeline struct {
+	Receivers []string `yaml:"receivers"`
+	Exporters []string `yaml:"exporters"`
+}
+
+// otelReceiverConfig represents `config` option of prometheus receiver.
+//
+// See https://github.com/open-telemetry/opentelemetry-collector-contrib/tree/main/receiver/prometheusreceiver
+type otelReceiverConfig struct {
+	Global        *promGlobalConfig `yaml:"global,omitempty"`
+	ScrapeConfigs []*yaml.Node      `yaml:"scrape_configs"`
+}
+
+// otelExporterConfig represents prometheusremotewrite exporter config.
+//
+// See https://github.com/open-telemetry/opentelemetry-collector-contrib/tree/main/exporter/prometheusremotewriteexporter
+type otelExporterConfig struct {
+	Endpoint         string                `yaml:"endpoint"`
+	Timeout          string                `yaml:"timeout,omitempty"`
+	Headers          map[string]string     `yaml:"headers,omitempty"`
+	ExternalLabels   map[string]string     `yaml:"external_labels,omitempty"`
+	TLS              *otelTLSConfig        `yaml:"tls,omitempty"`
+	Auth             *otelAuthConfig       `yaml:"auth,omitempty"`
+	RemoteWriteQueue *otelRemoteWriteQueue `yaml:"remote_write_queue,omitempty"`
+}
+
+type otelTLSConfig struct {
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+type otelAuthConfig struct {
+	Authenticator string `yaml:"authenticator"`
+}
+
+type otelRemoteWriteQueue struct {
+	QueueSize    int `yaml:"queue_size,omitempty"`
+	NumConsumers int `yaml:"num_consumers,omitempty"`
+}
+
+// marshalOTelConfig returns OpenTelemetry Collector config with scrape configs for targets belonging to ss.
+//
+// The remote write settings are taken from the same command-line flags as for /api/v1/prometheus/config.
+// The debug exporter is used if -remoteWriteURL isn't set, since the collector requires at least a single exporter.
+// Versions of targets are registered at rk.
+func marshalOTelConfig(targets []*target, ss shardSpec, rk *renderKey) ([]byte, error) {
+	rc := &otelReceiverConfig{
+		ScrapeConfigs: make([]*yaml.Node, len(targets)),
+	}
+	if promGlobal != nil && (promGlobal.ScrapeInterval > 0 || promGlobal.ScrapeTimeout > 0) {
+		// External labels are set at the exporter, since the receiver doesn't support them.
+		rc.Global = &promGlobalConfig{
+			ScrapeInterval: promGlobal.ScrapeInterval,
+			ScrapeTimeout:  promGlobal.ScrapeTimeout,
+		}
+	}
+	for i, t := range targets {
+		n, err := t.marshalPrometheus(ss, rk)
+		if err != nil {
+			return nil, err
+		}
+		// The collector expands environment variables in the config, so `$` must be escaped.
+		escapeDollars(n)
+		rc.ScrapeConfigs[i] = n
+	}
+	c := &otelConfig{
+		Receivers: map[string]any{
+			"prometheus": map[string]any{
+				"config": rc,
+			},
+		},
+	}
+	exporter := "debug"
+	c.Exporters = map[string]any{
+		"debug": map[string]string{
+			"verbosity": "basic",
+		},
+	}
+	if len(promRemoteWrite) > 0 {
+		rwc := promRemoteWrite[0]
+		exporter = "prometheusremotewrite"
+		ec := &otelExporterConfig{
+			Endpoint: rwc.URL,
+			Headers:  rwc.Headers,
+		}
+		if promGlobal != nil {
+			ec.ExternalLabels = promGlobal.ExternalLabels
+		}
+		if rwc.RemoteTimeout > 0 {
+			ec.Timeout = rwc.RemoteTimeout.String()
+		}
+		if rwc.TLSConfig != nil {
+			ec.TLS = &otelTLSConfig{
+				InsecureSkipVerify: rwc.TLSConfig.InsecureSkipVerify,
+			}
+		}
+		if qc := rwc.QueueConfig; qc != nil && (qc.Capacity > 0 || qc.MaxShards > 0) {
+			ec.RemoteWriteQueue = &otelRemoteWriteQueue{
+				QueueSize:    qc.Capacity,
+				NumConsumers: qc.MaxShards,
+			}
+		}
+		switch {
+		case rwc.BasicAuth != nil:
+			ec.Auth = &otelAuthConfig{
+				Authenticator: "basicauth/prw",
+			}
+			clientAuth := map[string]string{
+				"username": rwc.BasicAuth.Username,
+			}
+			if len(rwc.BasicAuth.PasswordFile) > 0 {
+				clientAuth["password"] = "${file:" + rwc.BasicAuth.PasswordFile + "}"
+			}
+			c.Extensions = map[string]any{
+				"basicauth/prw": map[string]any{
+					"client_auth": clientAuth,
+				},
+			}
+		case rwc.Authorization != nil:
+			ec.Auth = &otelAuthConfig{
+				Authenticator: "bearertokenauth/prw",
+			}
+			c.Extensions = map[string]any{
+				"bearertokenauth/prw": map[string]string{
+					"filename": rwc.Authorization.CredentialsFile,
+				},
+			}
+		}
+		c.Exporters = map[string]any{
+			exporter: ec,
+		}
+	}
+	for name := range c.Extensions {
+		c.Service.Extensions = append(c.Service.Extensions, name)
+	}
+	c.Service.Pipelines = map[string]otelPipeline{
+		"metrics": {
+			Receivers: []string{"prometheus"},
+			Exporters: []string{exporter},
+		},
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling OpenTelemetry Collector config: %s", err)
+	}
+	return data, nil
+}
+
+// escapeDollars replaces `$` with `$$` in all the scalar values at n.
+func escapeDollars(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode {
+		n.Value = strings.ReplaceAll(n.Value, "$", "$$")
+	}
+	for _, c := range n.Content {
+		escapeDollars(c)
+	}
+}
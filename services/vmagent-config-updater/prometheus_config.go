@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	promScrapeInterval  = flag.Duration("promScrapeInterval", 0, "Optional global scrape_interval for the config returned from /api/v1/prometheus/config")
+	promScrapeTimeout   = flag.Duration("promScrapeTimeout", 0, "Optional global scrape_timeout for the config returned from /api/v1/prometheus/config")
+	promExternalLabels  = flag.String("promExternalLabels", "", "Optional comma-separated list of external_labels for the config returned from /api/v1/prometheus/config, e.g. 'cluster=foo,replica=a'")
+	remoteWriteURL      = flag.String("remoteWriteURL", "", "Remote write url for the config returned from /api/v1/prometheus/config. remote_write section is omitted if it isn't set")
+	remoteWriteName     = flag.String("remoteWriteName", "", "Optional name for the remote_write section")
+	remoteWriteTimeout  = flag.Duration("remoteWriteTimeout", 0, "Optional remote_timeout for the remote_write section")
+	remoteWriteHeaders  = flag.String("remoteWriteHeaders", "", "Optional HTTP headers to send with remote write requests. Headers must be delimited by '^^', e.g. 'X-Foo: bar^^X-Baz: qux'")
+	remoteWriteUsername = flag.String("remoteWriteBasicAuthUsername", "", "Optional basic auth username for the remote_write section")
+	remoteWritePassword = flag.String("remoteWriteBasicAuthPasswordFile", "", "Optional path to basic auth password for the remote_write section")
+	remoteWriteBearer   = flag.String("remoteWriteBearerTokenFile", "", "Optional path to bearer token for the remote_write section")
+	remoteWriteInsecure = flag.Bool("remoteWriteTLSInsecureSkipVerify", false, "Whether to skip TLS certificate verification for remote write url")
+
+	queueCapacity          = flag.Int("remoteWriteQueueCapacity", 0, "Optional queue_config.capacity for the remote_write section")
+	queueMinShards         = flag.Int("remoteWriteQueueMinShards", 0, "Optional queue_config.min_shards for the remote_write section")
+	queueMaxShards         = flag.Int("remoteWriteQueueMaxShards", 0, "Optional queue_config.max_shards for the remote_write section")
+	queueMaxSamplesPerSend = flag.Int("remoteWriteQueueMaxSamplesPerSend", 0, "Optional queue_config.max_samples_per_send for the remote_write section")
+	queueBatchSendDeadline = flag.Duration("remoteWriteQueueBatchSendDeadline", 0, "Optional queue_config.batch_send_deadline for the remote_write section")
+	queueMinBackoff        = flag.Duration("remoteWriteQueueMinBackoff", 0, "Optional queue_config.min_backoff for the remote_write section")
+	queueMaxBackoff        = flag.Duration("remoteWriteQueueMaxBackoff", 0, "Optional queue_config.max_backoff for the remote_write section")
+)
+
+// prometheusConfig represents Prometheus config, which can be used by Prometheus server and Prometheus in agent mode.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/
+type prometheusConfig struct {
+	Global        *promGlobalConfig    `yaml:"global,omitempty"`
+	RemoteWrite   []*remoteWriteConfig `yaml:"remote_write,omitempty"`
+	ScrapeConfigs []*yaml.Node         `yaml:"scrape_configs"`
+}
+
+type promGlobalConfig struct {
+	ScrapeInterval time.Duration     `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  time.Duration     `yaml:"scrape_timeout,omitempty"`
+	ExternalLabels map[string]string `yaml:"external_labels,omitempty"`
+}
+
+// remoteWriteConfig represents `remote_write` section of Prometheus config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#remote_write
+type remoteWriteConfig struct {
+	URL           string               `yaml:"url"`
+	Name          string               `yaml:"name,omitempty"`
+	RemoteTimeout time.Duration        `yaml:"remote_timeout,omitempty"`
+	Headers       map[string]string    `yaml:"headers,omitempty"`
+	BasicAuth     *basicAuthConfig     `yaml:"basic_auth,omitempty"`
+	Authorization *authorizationConfig `yaml:"authorization,omitempty"`
+	TLSConfig     *tlsConfig           `yaml:"tls_config,omitempty"`
+	QueueConfig   *queueConfig         `yaml:"queue_config,omitempty"`
+}
+
+type queueConfig struct {
+	Capacity          int           `yaml:"capacity,omitempty"`
+	MinShards         int           `yaml:"min_shards,omitempty"`
+	MaxShards         int           `yaml:"max_shards,omitempty"`
+	MaxSamplesPerSend int           `yaml:"max_samples_per_send,omitempty"`
+	BatchSendDeadline time.Duration `yaml:"batch_send_deadline,omitempty"`
+	MinBackoff        time.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff        time.Duration `yaml:"max_backoff,omitempty"`
+}
+
+// promGlobal and promRemoteWrite are initialized from command-line flags by initPrometheusConfig.
+var (
+	promGlobal      *promGlobalConfig
+	promRemoteWrite []*remoteWriteConfig
+)
+
+// initPrometheusConfig initializes global and remote_write sections for /api/v1/prometheus/config from command-line flags.
+func initPrometheusConfig() {
+	externalLabels, err := parseExternalLabels(*promExternalLabels)
+	if err != nil {
+		log.Fatalf("cannot parse -promExternalLabels: %s", err)
+	}
+	if *promScrapeInterval > 0 || *promScrapeTimeout > 0 || len(externalLabels) > 0 {
+		promGlobal = &promGlobalConfig{
+			ScrapeInterval: *promScrapeInterval,
+			ScrapeTimeout:  *promScrapeTimeout,
+			ExternalLabels: externalLabels,
+		}
+	}
+	if len(*remoteWriteURL) == 0 {
+		return
+	}
+	headers, err := parseHeaders(*remoteWriteHeaders)
+	if err != nil {
+		log.Fatalf("cannot parse -remoteWriteHeaders: %s", err)
+	}
+	rwc := &remoteWriteConfig{
+		URL:           *remoteWriteURL,
+		Name:          *remoteWriteName,
+		RemoteTimeout: *remoteWriteTimeout,
+		Headers:       headers,
+	}
+	if len(*remoteWriteUsername) > 0 {
+		rwc.BasicAuth = &basicAuthConfig{
+			Username:     *remoteWriteUsername,
+			PasswordFile: *remoteWritePassword,
+		}
+	}
+	if len(*remoteWriteBearer) > 0 {
+		if rwc.BasicAuth != nil {
+			log.Fatalf("-remoteWriteBasicAuthUsername and -remoteWriteBearerTokenFile cannot be set simultaneously")
+		}
+		rwc.Authorization = &authorizationConfig{
+			CredentialsFile: *remoteWriteBearer,
+		}
+	}
+	if *remoteWriteInsecure {
+		rwc.TLSConfig = &tlsConfig{
+			InsecureSkipVerify: true,
+		}
+	}
+	qc := queueConfig{
+		Capacity:          *queueCapacity,
+		MinShards:         *queueMinShards,
+		MaxShards:         *queueMaxShards,
+		MaxSamplesPerSend: *queueMaxSamplesPerSend,
+		BatchSendDeadline: *queueBatchSendDeadline,
+		MinBackoff:        *queueMinBackoff,
+		MaxBackoff:        *queueMaxBackoff,
+	}
+	if qc != (queueConfig{}) {
+		rwc.QueueConfig = &qc
+	}
+	promRemoteWrite = []*remoteWriteConfig{rwc}
+}
+
+// parseExternalLabels parses comma-separated list of `name=value` pairs.
+func parseExternalLabels(s string) (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("missing `=` in %q; expecting `name=value`", kv)
+		}
+		m[name] = value
+	}
+	return m, nil
+}
+
+// parseHeaders parses `Name: value` pairs delimited by `^^`.
+func parseHeaders(s string) (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, h := range strings.Split(s, "^^") {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || len(strings.TrimSpace(name)) == 0 {
+			return nil, fmt.Errorf("missing `:` in %q; expecting `Name: value`", h)
+		}
+		m[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+// marshalPrometheusConfig returns Prometheus config with scrape configs for targets belonging to ss.
+func marshalPrometheusConfig(targets []*target, ss shardSpec, rk *renderKey) ([]byte, error) {
+	c := &prometheusConfig{
+		Global:        promGlobal,
+		RemoteWrite:   promRemoteWrite,
+		ScrapeConfigs: make([]*yaml.Node, len(targets)),
+	}
+	for i, t := range targets {
+		n, err := t.marshalPrometheus(ss, rk)
+		if err != nil {
+			return nil, err
+		}
+		c.ScrapeConfigs[i] = n
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling Prometheus config: %s", err)
+	}
+	return data, nil
+}
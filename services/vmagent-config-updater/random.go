@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+var randomSeed = flag.Int64("randomSeed", 0, "Seed for selecting targets to update every -scrapeConfigUpdateInterval. "+
+	"Runs with the same seed and job configs update the same targets at the same revisions unless the churn depends on the wall clock or on runtime config changes. "+
+	"A random seed is used if it is set to 0. The used seed is logged at startup, so the run can be reproduced")
+
+// initRandomSeed sets -randomSeed to a random value if it isn't set.
+func initRandomSeed() {
+	if *randomSeed == 0 {
+		*randomSeed = time.Now().UnixNano()
+	}
+	log.Printf("using -randomSeed=%d", *randomSeed)
+}
+
+// jobSeed returns seed for the job with the given name derived from -randomSeed.
+func jobSeed(jobName string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(jobName))
+	return splitmix64(uint64(*randomSeed) ^ h.Sum64())
+}
+
+// randFloat64 returns pseudo-random number in the range [0..1) for the given seed, revision and target index.
+//
+// The result is a pure function of its args, so it doesn't depend on the order and the number of previous calls.
+func randFloat64(seed uint64, rev, idx int) float64 {
+	return float64(randUint64(seed, rev, idx)>>11) / (1 << 53)
+}
+
+// randUint64 returns pseudo-random number for the given seed, revision and target index.
+//
+// The result is a pure function of its args. See randFloat64.
+func randUint64(seed uint64, rev, idx int) uint64 {
+	return splitmix64(seed ^ splitmix64(uint64(rev)) ^ splitmix64(splitmix64(uint64(idx))))
+}
+
+// splitmix64 mixes bits of x.
+//
+// See https://prng.di.unimi.it/splitmix64.c
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
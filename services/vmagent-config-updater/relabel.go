@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// relabelConfig represents a single entry for `relabel_configs` and `metric_relabel_configs` sections of Prometheus config.
+//
+// It also supports VictoriaMetrics-specific extensions such as `if`, `match` and `labels` options.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+// and https://docs.victoriametrics.com/vmagent/#relabeling
+type relabelConfig struct {
+	If           stringOrList      `yaml:"if,omitempty"`
+	Action       string            `yaml:"action,omitempty"`
+	SourceLabels []string          `yaml:"source_labels,flow,omitempty"`
+	Separator    *string           `yaml:"separator,omitempty"`
+	Regex        stringOrList      `yaml:"regex,omitempty"`
+	Modulus      uint64            `yaml:"modulus,omitempty"`
+	TargetLabel  string            `yaml:"target_label,omitempty"`
+	Replacement  *string           `yaml:"replacement,omitempty"`
+	Match        string            `yaml:"match,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+
+	// SourceLabel is the legacy `source_label` option accepted by previous versions of vmagent-config-updater.
+	// It is converted to SourceLabels when loading relabel configs.
+	SourceLabel string `yaml:"source_label,omitempty"`
+}
+
+// stringOrList holds a value, which may be set either to a single string or to a list of strings.
+//
+// VictoriaMetrics allows such values for `regex` and `if` relabeling options.
+type stringOrList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (sl *stringOrList) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		var s string
+		if err := n.Decode(&s); err != nil {
+			return err
+		}
+		*sl = []string{s}
+		return nil
+	case yaml.SequenceNode:
+		var a []string
+		if err := n.Decode(&a); err != nil {
+			return err
+		}
+		*sl = a
+		return nil
+	default:
+		return fmt.Errorf("line %d: expecting string or list of strings", n.Line)
+	}
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (sl stringOrList) MarshalYAML() (any, error) {
+	if len(sl) == 1 {
+		return sl[0], nil
+	}
+	return []string(sl), nil
+}
+
+// loadRelabelConfigs reads and validates relabel configs from the given path.
+func loadRelabelConfigs(path string) ([]*relabelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", path, err)
+	}
+	var rcs []*relabelConfig
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&rcs); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot parse %q: %w", path, err)
+	}
+	for i, rc := range rcs {
+		if rc != nil && len(rc.SourceLabel) > 0 {
+			if len(rc.SourceLabels) > 0 {
+				return nil, fmt.Errorf("relabel config #%d at %q cannot contain both `source_label` and `source_labels`", i+1, path)
+			}
+			rc.SourceLabels = []string{rc.SourceLabel}
+			rc.SourceLabel = ""
+		}
+		if err := rc.validate(); err != nil {
+			return nil, fmt.Errorf("invalid relabel config #%d at %q: %w", i+1, path, err)
+		}
+	}
+	return rcs, nil
+}
+
+// validate verifies whether rc contains all the options needed for rc.Action.
+func (rc *relabelConfig) validate() error {
+	if rc == nil {
+		return fmt.Errorf("relabel config cannot be empty")
+	}
+	if len(rc.Regex) > 0 {
+		expr := "^(?:" + strings.Join(rc.Regex, "|") + ")$"
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("cannot parse regex %q: %w", rc.Regex, err)
+		}
+	}
+	for _, s := range rc.If {
+		if len(strings.TrimSpace(s)) == 0 {
+			return fmt.Errorf("`if` cannot contain empty series selector")
+		}
+	}
+	action := rc.Action
+	if len(action) == 0 {
+		action = "replace"
+	}
+	switch action {
+	case "replace", "replace_all", "lowercase", "uppercase":
+		if len(rc.TargetLabel) == 0 {
+			return fmt.Errorf("missing `target_label` for `action: %s`", action)
+		}
+		if action != "replace" && len(rc.SourceLabels) == 0 {
+			return fmt.Errorf("missing `source_labels` for `action: %s`", action)
+		}
+	case "hashmod":
+		if len(rc.TargetLabel) == 0 {
+			return fmt.Errorf("missing `target_label` for `action: hashmod`")
+		}
+		if rc.Modulus == 0 {
+			return fmt.Errorf("`modulus` must be greater than 0 for `action: hashmod`")
+		}
+	case "keep_if_equal", "drop_if_equal":
+		if len(rc.SourceLabels) < 2 {
+			return fmt.Errorf("`action: %s` requires at least two `source_labels`", action)
+		}
+	case "keepequal", "dropequal", "keep_if_contains", "drop_if_contains":
+		if len(rc.SourceLabels) == 0 || len(rc.TargetLabel) == 0 {
+			return fmt.Errorf("`action: %s` requires both `source_labels` and `target_label`", action)
+		}
+	case "keep", "drop":
+		if len(rc.SourceLabels) == 0 && len(rc.If) == 0 {
+			return fmt.Errorf("`action: %s` requires either `source_labels` or `if`", action)
+		}
+	case "keep_metrics", "drop_metrics":
+		if len(rc.Regex) == 0 && len(rc.If) == 0 {
+			return fmt.Errorf("`action: %s` requires either `regex` or `if`", action)
+		}
+	case "labelmap", "labelmap_all", "labeldrop", "labelkeep":
+		if len(rc.Regex) == 0 && len(rc.If) == 0 && action != "labelmap" {
+			return fmt.Errorf("`action: %s` requires either `regex` or `if`", action)
+		}
+	case "graphite":
+		if len(rc.Match) == 0 {
+			return fmt.Errorf("missing `match` for `action: graphite`")
+		}
+		if len(rc.Labels) == 0 {
+			return fmt.Errorf("missing `labels` for `action: graphite`")
+		}
+	default:
+		return fmt.Errorf("unsupported `action: %s`", action)
+	}
+	if action != "graphite" && (len(rc.Match) > 0 || len(rc.Labels) > 0) {
+		return fmt.Errorf("`match` and `labels` options are supported only for `action: graphite`")
+	}
+	if action != "hashmod" && rc.Modulus > 0 {
+		return fmt.Errorf("`modulus` is supported only for `action: hashmod`")
+	}
+	return nil
+}
+
+// checkPrometheusCompatible returns an error if rc uses VictoriaMetrics-specific extensions, which aren't supported by Prometheus.
+func (rc *relabelConfig) checkPrometheusCompatible() error {
+	if len(rc.If) > 0 {
+		return fmt.Errorf("`if` option isn't supported by Prometheus")
+	}
+	if len(rc.Regex) > 1 {
+		return fmt.Errorf("list of regexps at `regex` option isn't supported by Prometheus")
+	}
+	switch rc.Action {
+	case "", "replace", "keep", "drop", "hashmod", "labelmap", "labeldrop", "labelkeep", "lowercase", "uppercase", "keepequal", "dropequal":
+		return nil
+	default:
+		return fmt.Errorf("`action: %s` isn't supported by Prometheus", rc.Action)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var scenarioPath = flag.String("scenario", "", "Optional path to YAML file with benchmark phases such as warmup, steady, storm, spike and cooldown. "+
+	"Every phase may override targets_count, scrape_interval and churn settings for the configured jobs. "+
+	"See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#scenarios")
+
+// scenario represents the contents of -scenario file.
+type scenario struct {
+	// Loop enables restarting the scenario from the first phase after the last phase ends.
+	Loop   bool             `yaml:"loop,omitempty"`
+	Phases []*scenarioPhase `yaml:"phases"`
+}
+
+// scenarioPhase is a named benchmark phase with overrides for job configs.
+type scenarioPhase struct {
+	Name     string        `yaml:"name"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+
+	// Overrides are applied to all the jobs.
+	Overrides jobOverrides `yaml:",inline"`
+
+	// Jobs contains per-job overrides, which are applied on top of Overrides.
+	Jobs map[string]*jobOverrides `yaml:"jobs,omitempty"`
+}
+
+// jobOverrides contains job config options, which can be overridden by scenario phases and via admin API.
+//
+// Zero values mean the option isn't overridden.
+type jobOverrides struct {
+	TargetsCount   int           `yaml:"targets_count,omitempty"`
+	ScrapeInterval time.Duration `yaml:"scrape_interval,omitempty"`
+	UpdateInterval time.Duration `yaml:"update_interval,omitempty"`
+	UpdatePercent  *float64      `yaml:"update_percent,omitempty"`
+	Churn          *churnConfig  `yaml:"churn,omitempty"`
+}
+
+// loadScenario reads and validates -scenario file for the given job configs.
+//
+// It returns nil if -scenario isn't set.
+func loadScenario(jcs []*jobConfig) (*scenario, error) {
+	if len(*scenarioPath) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(*scenarioPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read -scenario=%q: %w", *scenarioPath, err)
+	}
+	var sc scenario
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&sc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot parse -scenario=%q: %w", *scenarioPath, err)
+	}
+	if err := sc.validate(jcs); err != nil {
+		return nil, fmt.Errorf("invalid -scenario=%q: %w", *scenarioPath, err)
+	}
+	return &sc, nil
+}
+
+func (sc *scenario) validate(jcs []*jobConfig) error {
+	if len(sc.Phases) == 0 {
+		return fmt.Errorf("at least a single phase must be configured")
+	}
+	jobNames := make(map[string]struct{}, len(jcs))
+	for _, jc := range jcs {
+		jobNames[jc.ScrapeConfig.JobName] = struct{}{}
+	}
+	seen := make(map[string]struct{}, len(sc.Phases))
+	for i, p := range sc.Phases {
+		if p == nil {
+			return fmt.Errorf("phase #%d cannot be empty", i+1)
+		}
+		if len(p.Name) == 0 {
+			return fmt.Errorf("missing `name` for phase #%d", i+1)
+		}
+		if _, ok := seen[p.Name]; ok {
+			return fmt.Errorf("duplicate phase name %q", p.Name)
+		}
+		seen[p.Name] = struct{}{}
+		isLast := i == len(sc.Phases)-1
+		if p.Duration < 0 || p.Duration == 0 && (sc.Loop || !isLast) {
+			return fmt.Errorf("`duration` must be positive for phase %q; it may be omitted only for the last phase if `loop` isn't set", p.Name)
+		}
+		for name := range p.Jobs {
+			if _, ok := jobNames[name]; !ok {
+				return fmt.Errorf("unknown job %q at `jobs` for phase %q", name, p.Name)
+			}
+		}
+		for _, jc := range jcs {
+			if _, err := p.apply(jc); err != nil {
+				return fmt.Errorf("cannot apply phase %q to job %q: %w", p.Name, jc.ScrapeConfig.JobName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns a copy of jc with overrides from p.
+func (p *scenarioPhase) apply(jc *jobConfig) (*jobConfig, error) {
+	pjc := *jc
+	p.Overrides.apply(&pjc)
+	if po := p.Jobs[jc.ScrapeConfig.JobName]; po != nil {
+		po.apply(&pjc)
+	}
+	pjc.setDefaults()
+	if err := pjc.validate(); err != nil {
+		return nil, err
+	}
+	return &pjc, nil
+}
+
+func (po *jobOverrides) apply(jc *jobConfig) {
+	if po.TargetsCount > 0 {
+		jc.TargetsCount = po.TargetsCount
+	}
+	if po.ScrapeInterval > 0 {
+		jc.ScrapeConfig.ScrapeInterval = po.ScrapeInterval
+	}
+	if po.UpdateInterval > 0 {
+		jc.UpdateInterval = po.UpdateInterval
+	}
+	if po.UpdatePercent != nil {
+		jc.UpdatePercent = po.UpdatePercent
+	}
+	if po.Churn != nil {
+		jc.Churn = *po.Churn
+	}
+}
+
+// runScenario applies phases from sc to js one by one.
+//
+// The last phase stays active after its duration ends unless sc.Loop is set.
+func runScenario(js *jobs, sc *scenario) {
+	for {
+		for _, p := range sc.Phases {
+			log.Printf("starting scenario phase %q for %s", p.Name, p.Duration)
+			js.setPhase(p)
+			if p.Duration == 0 {
+				return
+			}
+			time.Sleep(p.Duration)
+		}
+		if !sc.Loop {
+			log.Printf("scenario is finished; the last phase %q stays active", sc.Phases[len(sc.Phases)-1].Name)
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+var (
+	scrapeTimeout = newArrayFlag("scrapeTimeout", time.Duration(0), "Optional scrape_timeout to set at the scrape config returned from -httpListenAddr. It mustn't exceed -scrapeInterval")
+	metricsPath   = newArrayFlag("metricsPath", "", "Optional metrics_path to set at the scrape config returned from -httpListenAddr")
+	scrapeParams  = newArrayFlag("scrapeParams", "", "Optional params to set at the scrape config returned from -httpListenAddr. "+
+		"Params must be specified in url query format, e.g. 'module=foo&target=bar'")
+	scrapeScheme        = newArrayFlag("scrapeScheme", "", "Optional scheme to set at the scrape config returned from -httpListenAddr. Supported values: http, https")
+	honorLabels         = newArrayFlag("honorLabels", false, "Whether to set honor_labels: true at the scrape config returned from -httpListenAddr")
+	honorTimestamps     = newArrayFlag("honorTimestamps", true, "Whether to set honor_timestamps: false at the scrape config returned from -httpListenAddr")
+	sampleLimit         = newArrayFlag("sampleLimit", 0, "Optional sample_limit to set at the scrape config returned from -httpListenAddr")
+	labelLimit          = newArrayFlag("labelLimit", 0, "Optional label_limit to set at the scrape config returned from -httpListenAddr")
+	bodySizeLimit       = newArrayFlag("bodySizeLimit", "", "Optional body_size_limit to set at the scrape config returned from -httpListenAddr, e.g. 10MB")
+	seriesLimit         = newArrayFlag("seriesLimit", 0, "Optional VictoriaMetrics-specific series_limit to set at the scrape config returned from -httpListenAddr")
+	streamParse         = newArrayFlag("streamParse", false, "Whether to set VictoriaMetrics-specific stream_parse: true at the scrape config returned from -httpListenAddr")
+	scrapeAlignInterval = newArrayFlag("scrapeAlignInterval", time.Duration(0), "Optional VictoriaMetrics-specific scrape_align_interval to set at the scrape config returned from -httpListenAddr")
+)
+
+// setOptions sets optional scrape options for sc from command-line flags for the job with the given idx.
+func (sc *scrapeConfig) setOptions(idx int) error {
+	sc.ScrapeTimeout = scrapeTimeout.getArg(idx)
+	sc.MetricsPath = metricsPath.getArg(idx)
+	if params := scrapeParams.getArg(idx); len(params) > 0 {
+		qs, err := url.ParseQuery(params)
+		if err != nil {
+			return fmt.Errorf("cannot parse params %q: %w", params, err)
+		}
+		sc.Params = qs
+	}
+	sc.Scheme = scrapeScheme.getArg(idx)
+	sc.HonorLabels = honorLabels.getArg(idx)
+	if !honorTimestamps.getArg(idx) {
+		v := false
+		sc.HonorTimestamps = &v
+	}
+	sc.SampleLimit = sampleLimit.getArg(idx)
+	sc.LabelLimit = labelLimit.getArg(idx)
+	sc.BodySizeLimit = bodySizeLimit.getArg(idx)
+	sc.SeriesLimit = seriesLimit.getArg(idx)
+	sc.StreamParse = streamParse.getArg(idx)
+	sc.ScrapeAlignInterval = scrapeAlignInterval.getArg(idx)
+	sc.HTTPConfig = newHTTPConfig(idx)
+	return nil
+}
+
+// validate verifies scrape options at sc.
+func (sc *scrapeConfig) validate() error {
+	if len(sc.JobName) == 0 {
+		return fmt.Errorf("missing `job_name`")
+	}
+	if sc.ScrapeInterval <= 0 {
+		return fmt.Errorf("`scrape_interval` must be positive; got %s", sc.ScrapeInterval)
+	}
+	if sc.ScrapeTimeout > sc.ScrapeInterval {
+		return fmt.Errorf("`scrape_timeout`=%s cannot exceed `scrape_interval`=%s", sc.ScrapeTimeout, sc.ScrapeInterval)
+	}
+	switch sc.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("unsupported `scheme: %s`; supported values: http, https", sc.Scheme)
+	}
+	if len(sc.StaticConfigs) > 0 {
+		return fmt.Errorf("`static_configs` cannot be set, since they are generated")
+	}
+	if len(sc.KubernetesSDConfigs) > 0 {
+		return fmt.Errorf("`kubernetes_sd_configs` cannot be set, since they are generated at /api/v1/k8s/config")
+	}
+	if len(sc.ConsulSDConfigs) > 0 {
+		return fmt.Errorf("`consul_sd_configs` cannot be set, since they are generated at /api/v1/consul/config")
+	}
+	for i, rc := range sc.RelabelConfigs {
+		if err := rc.validate(); err != nil {
+			return fmt.Errorf("invalid `relabel_configs` entry #%d: %w", i+1, err)
+		}
+	}
+	for i, rc := range sc.MetricRelabelConfigs {
+		if err := rc.validate(); err != nil {
+			return fmt.Errorf("invalid `metric_relabel_configs` entry #%d: %w", i+1, err)
+		}
+	}
+	if sc.HTTPConfig != nil {
+		return sc.HTTPConfig.validate()
+	}
+	return nil
+}
+
+// prometheusCompatible returns a copy of sc without VictoriaMetrics-specific options.
+//
+// VictoriaMetrics-specific scrape options such as `series_limit`, `stream_parse` and `scrape_align_interval` are dropped,
+// while an error is returned if relabeling rules contain VictoriaMetrics-specific extensions, since they change the scraped data.
+func (sc *scrapeConfig) prometheusCompatible() (*scrapeConfig, error) {
+	for _, rc := range sc.RelabelConfigs {
+		if err := rc.checkPrometheusCompatible(); err != nil {
+			return nil, fmt.Errorf("unsupported `relabel_configs` for job %q: %w", sc.JobName, err)
+		}
+	}
+	for _, rc := range sc.MetricRelabelConfigs {
+		if err := rc.checkPrometheusCompatible(); err != nil {
+			return nil, fmt.Errorf("unsupported `metric_relabel_configs` for job %q: %w", sc.JobName, err)
+		}
+	}
+	c := *sc
+	c.SeriesLimit = 0
+	c.StreamParse = false
+	c.ScrapeAlignInterval = 0
+	return &c, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var isReady atomic.Bool
+
+// setReady marks vmagent-config-updater as ready to serve requests at /ready.
+func setReady() {
+	isReady.Store(true)
+}
+
+// newRequestHandler returns handler for all the HTTP endpoints exposed by vmagent-config-updater.
+func newRequestHandler(js *jobs) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<h2>vmagent-config-updater</h2>")
+		fmt.Fprintf(w, `<a href="/api/v1/config">/api/v1/config</a> - scrape config for all the jobs<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/prometheus/config">/api/v1/prometheus/config</a> - Prometheus server and Prometheus agent config for all the jobs<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/otel/config">/api/v1/otel/config</a> - OpenTelemetry Collector config for all the jobs<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/alloy/config">/api/v1/alloy/config</a> - Grafana Alloy config for all the jobs<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/k8s/config">/api/v1/k8s/config</a> - scrape config with kubernetes_sd_configs for the fake Kubernetes API at -k8sAPIListenAddr<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/consul/config">/api/v1/consul/config</a> - scrape config with consul_sd_configs for Consul catalog API emulation at -consulListenAddr<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/jobs">/api/v1/jobs</a> - the current state of all the jobs<br>`)
+		fmt.Fprintf(w, `/api/v1/sd/&lt;job_name&gt; - http_sd_configs targets for the given job<br>`)
+		fmt.Fprintf(w, `/api/v1/config/diff?from=&lt;revision&gt; - targets added, removed and relabeled since the given revision<br>`)
+		fmt.Fprintf(w, `<a href="/api/v1/churn/events">/api/v1/churn/events</a> - the most recent churn events<br>`)
+		fmt.Fprintf(w, `/api/v1/admin/jobs/&lt;job_name&gt; - admin API for updating the given job; requires -adminAuthKey<br>`)
+		fmt.Fprintf(w, `<a href="/metrics">/metrics</a> - self-instrumentation metrics<br>`)
+		fmt.Fprintf(w, `<a href="/health">/health</a> - health check<br>`)
+		fmt.Fprintf(w, `<a href="/ready">/ready</a> - readiness check<br>`)
+	})
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintf(w, "OK")
+	})
+	mux.HandleFunc("GET /ready", func(w http.ResponseWriter, _ *http.Request) {
+		if !isReady.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		metrics.writePrometheus(w)
+		writeJobsMetrics(w, js)
+	})
+	mux.HandleFunc("GET /api/v1/config", instrument("/api/v1/config", func(w http.ResponseWriter, r *http.Request) {
+		ss, err := parseShardSpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cacheName := fmt.Sprintf("config/%d/%d", ss.shard, ss.shards)
+		cr, _ := responses.get(cacheName, targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/config"}`).updateDuration(time.Now())
+			c := &config{
+				ScrapeConfigs: make([]*yaml.Node, len(targets)),
+			}
+			for i, t := range targets {
+				c.ScrapeConfigs[i] = t.marshal(ss, rk)
+			}
+			return c.marshalYAML(), nil
+		})
+		cr.serve(w, r, "text/yaml")
+	}))
+	mux.HandleFunc("GET /api/v1/prometheus/config", instrument("/api/v1/prometheus/config", func(w http.ResponseWriter, r *http.Request) {
+		ss, err := parseShardSpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cacheName := fmt.Sprintf("prometheus/%d/%d", ss.shard, ss.shards)
+		cr, err := responses.get(cacheName, targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/prometheus/config"}`).updateDuration(time.Now())
+			return marshalPrometheusConfig(targets, ss, rk)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cr.serve(w, r, "text/yaml")
+	}))
+	mux.HandleFunc("GET /api/v1/otel/config", instrument("/api/v1/otel/config", func(w http.ResponseWriter, r *http.Request) {
+		ss, err := parseShardSpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cacheName := fmt.Sprintf("otel/%d/%d", ss.shard, ss.shards)
+		cr, err := responses.get(cacheName, targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/otel/config"}`).updateDuration(time.Now())
+			return marshalOTelConfig(targets, ss, rk)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cr.serve(w, r, "text/yaml")
+	}))
+	mux.HandleFunc("GET /api/v1/alloy/config", instrument("/api/v1/alloy/config", func(w http.ResponseWriter, r *http.Request) {
+		ss, err := parseShardSpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cacheName := fmt.Sprintf("alloy/%d/%d", ss.shard, ss.shards)
+		cr, err := responses.get(cacheName, targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/alloy/config"}`).updateDuration(time.Now())
+			return marshalAlloyConfig(targets, ss, rk)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cr.serve(w, r, "text/plain; charset=utf-8")
+	}))
+	mux.HandleFunc("GET /api/v1/sd/{job}", instrument("/api/v1/sd", func(w http.ResponseWriter, r *http.Request) {
+		ss, err := parseShardSpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job := r.PathValue("job")
+		t := js.getTarget(job)
+		if t == nil {
+			http.Error(w, fmt.Sprintf("cannot find job %q", job), http.StatusNotFound)
+			return
+		}
+		cacheName := fmt.Sprintf("sd/%s/%d/%d", job, ss.shard, ss.shards)
+		cr, _ := responses.get(cacheName, targetsCacheKey([]*target{t}), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/sd"}`).updateDuration(time.Now())
+			return t.marshalSD(ss, rk), nil
+		})
+		cr.serve(w, r, "application/json")
+	}))
+	mux.HandleFunc("GET /api/v1/jobs", instrument("/api/v1/jobs", func(w http.ResponseWriter, _ *http.Request) {
+		targets := js.getTargets()
+		jss := make([]*jobStatus, len(targets))
+		for i, t := range targets {
+			jss[i] = t.status()
+		}
+		writeJSON(w, jss)
+	}))
+	mux.HandleFunc("GET /api/v1/config/diff", instrument("/api/v1/config/diff", func(w http.ResponseWriter, r *http.Request) {
+		from, err := strconv.Atoi(r.FormValue("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse `from` arg: %s", err), http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		if job := r.FormValue("job"); len(job) > 0 {
+			t := js.getTarget(job)
+			if t == nil {
+				http.Error(w, fmt.Sprintf("unknown job %q", job), http.StatusNotFound)
+				return
+			}
+			targets = []*target{t}
+		}
+		ds := make([]*configDiff, len(targets))
+		for i, t := range targets {
+			d, err := t.diff(from)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ds[i] = d
+		}
+		writeJSON(w, ds)
+	}))
+	mux.HandleFunc("GET /api/v1/churn/events", instrument("/api/v1/churn/events", func(w http.ResponseWriter, r *http.Request) {
+		limit := *churnLogSize
+		if s := r.FormValue("limit"); len(s) > 0 {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("`limit` must be non-negative integer; got %q", s), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, churnEvents.getEvents(r.FormValue("job"), limit))
+	}))
+	mux.HandleFunc("GET /api/v1/k8s/config", instrument("/api/v1/k8s/config", func(w http.ResponseWriter, r *http.Request) {
+		if len(*k8sAPIListenAddr) == 0 {
+			http.Error(w, "fake Kubernetes API is disabled; set -k8sAPIListenAddr for enabling it", http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cr, _ := responses.get("k8s", targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/k8s/config"}`).updateDuration(time.Now())
+			c := &config{
+				ScrapeConfigs: make([]*yaml.Node, len(targets)),
+			}
+			for i, t := range targets {
+				c.ScrapeConfigs[i] = t.marshalK8s(rk)
+			}
+			return c.marshalYAML(), nil
+		})
+		cr.serve(w, r, "text/yaml")
+	}))
+	mux.HandleFunc("GET /api/v1/consul/config", instrument("/api/v1/consul/config", func(w http.ResponseWriter, r *http.Request) {
+		if len(*consulListenAddr) == 0 {
+			http.Error(w, "Consul catalog API emulation is disabled; set -consulListenAddr for enabling it", http.StatusBadRequest)
+			return
+		}
+		targets := js.getTargets()
+		cr, _ := responses.get("consul", targetsCacheKey(targets), func(rk *renderKey) ([]byte, error) {
+			defer metrics.getOrCreateHistogram(`vmagent_config_updater_marshal_duration_seconds{path="/api/v1/consul/config"}`).updateDuration(time.Now())
+			c := &config{
+				ScrapeConfigs: make([]*yaml.Node, len(targets)),
+			}
+			for i, t := range targets {
+				c.ScrapeConfigs[i] = t.marshalConsul(rk)
+			}
+			return c.marshalYAML(), nil
+		})
+		cr.serve(w, r, "text/yaml")
+	}))
+	registerAdminHandlers(mux, js)
+	return mux
+}
+
+// targetsCacheKey returns cache key for responses generated from the current state of targets. See renderKey.
+func targetsCacheKey(targets []*target) string {
+	var rk renderKey
+	for _, t := range targets {
+		version, modified := t.getVersion()
+		rk.add(t, version, modified)
+	}
+	return rk.key.String()
+}
+
+// writeJSON writes v as JSON response to w.
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling %T: %s", v, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// instrument wraps h with metrics for the number of served requests and response bytes for the given path.
+func instrument(path string, h http.HandlerFunc) http.HandlerFunc {
+	requests := metrics.getOrCreateCounter(`vmagent_config_updater_http_requests_total{path=` + quoteLabelValue(path) + `}`)
+	responseBytes := metrics.getOrCreateCounter(`vmagent_config_updater_http_response_bytes_total{path=` + quoteLabelValue(path) + `}`)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests.inc()
+		cw := &countingResponseWriter{ResponseWriter: w}
+		h(cw, r)
+		responseBytes.add(cw.n)
+	}
+}
+
+// countingResponseWriter counts the number of bytes written to ResponseWriter.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// Flush implements http.Flusher, so streaming responses such as Kubernetes watch work via instrument.
+func (cw *countingResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
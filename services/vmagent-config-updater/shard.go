@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// shardSpec defines a subset of targets to return to a single agent out of many agents.
+//
+// Targets are assigned to shards by their id, so every target belongs to exactly one shard
+// and the assignment doesn't change when targets are updated, added or removed.
+type shardSpec struct {
+	shard  int
+	shards int
+}
+
+// allShards is shardSpec, which selects all the targets.
+var allShards = shardSpec{shard: 0, shards: 1}
+
+// parseShardSpec parses `shard` and `shards` query args from r.
+//
+// allShards is returned if these args are missing.
+func parseShardSpec(r *http.Request) (shardSpec, error) {
+	shardStr := r.FormValue("shard")
+	shardsStr := r.FormValue("shards")
+	if len(shardStr) == 0 && len(shardsStr) == 0 {
+		return allShards, nil
+	}
+	shard, err := strconv.Atoi(shardStr)
+	if err != nil {
+		return shardSpec{}, fmt.Errorf("cannot parse `shard` query arg: %w", err)
+	}
+	shards, err := strconv.Atoi(shardsStr)
+	if err != nil {
+		return shardSpec{}, fmt.Errorf("cannot parse `shards` query arg: %w", err)
+	}
+	if shards <= 0 {
+		return shardSpec{}, fmt.Errorf("`shards` query arg must be positive; got %d", shards)
+	}
+	if shard < 0 || shard >= shards {
+		return shardSpec{}, fmt.Errorf("`shard` query arg must be in the range [0..%d]; got %d", shards-1, shard)
+	}
+	return shardSpec{shard: shard, shards: shards}, nil
+}
+
+// filter returns static configs from scs belonging to ss.
+func (ss shardSpec) filter(scs []*staticConfig) []*staticConfig {
+	if ss.shards == 1 {
+		return scs
+	}
+	result := make([]*staticConfig, 0, len(scs)/ss.shards+1)
+	for _, sc := range scs {
+		if sc.id%ss.shards == ss.shard {
+			result = append(result, sc)
+		}
+	}
+	return result
+}
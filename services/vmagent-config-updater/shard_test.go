@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShardsPartitionTargets(t *testing.T) {
+	for _, mode := range []string{"relabel", "replace", "resize"} {
+		t.Run(mode, func(t *testing.T) {
+			js := &jobs{}
+			applyJobsConfig(t, js, fmt.Sprintf(`
+jobs:
+- job_name: job
+  targets_count: 10
+  update_interval: 1m
+  update_percent: 30
+  churn:
+    mode: %s
+    min_targets: 1
+    max_targets: 20
+`, mode))
+			t.Cleanup(func() {
+				js.update(nil)
+			})
+			h := newRequestHandler(js)
+			tg := js.getTarget("job")
+			now := time.Now()
+			for i := 0; i < 5; i++ {
+				all := getTargetInstances(t, h, "/api/v1/sd/job")
+				for _, shards := range []int{1, 2, 3, 7, len(all), len(all) + 3} {
+					seen := make(map[string]int)
+					for shard := 0; shard < shards; shard++ {
+						for _, instance := range getTargetInstances(t, h, fmt.Sprintf("/api/v1/sd/job?shard=%d&shards=%d", shard, shards)) {
+							seen[instance]++
+						}
+					}
+					if len(seen) != len(all) {
+						t.Fatalf("shards=%d must cover all the %d targets; got %d targets: %v", shards, len(all), len(seen), seen)
+					}
+					for _, instance := range all {
+						if n := seen[instance]; n != 1 {
+							t.Fatalf("target %q must belong to a single shard out of %d; it belongs to %d shards", instance, shards, n)
+						}
+					}
+				}
+				now = now.Add(time.Minute)
+				tg.tick(now)
+			}
+		})
+	}
+}
+
+// getTargetInstances returns instance labels for targets returned by h at the given http_sd path.
+func getTargetInstances(t *testing.T, h http.Handler, path string) []string {
+	t.Helper()
+	resp := serveRequest(h, path, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for %s; got %d; want %d", path, resp.Code, http.StatusOK)
+	}
+	var scs []*staticConfig
+	if err := json.Unmarshal(resp.Body.Bytes(), &scs); err != nil {
+		t.Fatalf("cannot parse response for %s: %s", path, err)
+	}
+	instances := make([]string, len(scs))
+	for i, sc := range scs {
+		instances[i] = sc.Labels["instance"]
+	}
+	return instances
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	stateFile = flag.String("stateFile", "", "Optional path to file for persisting churn state across restarts. "+
+		"The state contains revisions for every job and its targets, so restarts don't generate artificial churn. "+
+		"The state is loaded at startup and is flushed every -stateFlushInterval and on graceful shutdown")
+	stateFlushInterval = flag.Duration("stateFlushInterval", 10*time.Second, "Interval for flushing churn state to -stateFile")
+)
+
+// savedState represents the contents of -stateFile.
+type savedState struct {
+	RandomSeed int64                `json:"random_seed"`
+	Jobs       map[string]*jobState `json:"jobs"`
+}
+
+// jobState is the persisted churn state for a single job.
+type jobState struct {
+	Revision     int           `json:"revision"`
+	Ticks        int           `json:"ticks"`
+	NextID       int           `json:"next_id"`
+	TargetsCount int           `json:"targets_count"`
+	StartTime    time.Time     `json:"start_time"`
+	Targets      []targetState `json:"targets"`
+
+	// Topology contains pods for jobs with topology config.
+	Topology *topologyState `json:"topology,omitempty"`
+}
+
+// targetState is the persisted state for a single target.
+type targetState struct {
+	ID       int `json:"id"`
+	Revision int `json:"revision"`
+}
+
+var (
+	loadedStatesMu sync.Mutex
+	loadedStates   map[string]*jobState
+)
+
+// initState loads -stateFile if it is set.
+//
+// It must be called before initRandomSeed, since the persisted seed is used if -randomSeed isn't set.
+func initState() {
+	if len(*stateFile) == 0 {
+		return
+	}
+	if *stateFlushInterval <= 0 {
+		log.Fatalf("-stateFlushInterval must be positive; got %s", *stateFlushInterval)
+	}
+	data, err := os.ReadFile(*stateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("-stateFile=%q doesn't exist; starting with empty state", *stateFile)
+			return
+		}
+		log.Fatalf("cannot read -stateFile=%q: %s", *stateFile, err)
+	}
+	var ss savedState
+	if err := json.Unmarshal(data, &ss); err != nil {
+		log.Fatalf("cannot parse -stateFile=%q: %s", *stateFile, err)
+	}
+	if *randomSeed == 0 {
+		*randomSeed = ss.RandomSeed
+	}
+	loadedStates = ss.Jobs
+	log.Printf("loaded state for %d jobs from -stateFile=%q", len(ss.Jobs), *stateFile)
+}
+
+// popLoadedState returns the state loaded from -stateFile for the given job.
+//
+// The state is returned only once, so jobs re-added during config reload start from scratch.
+func popLoadedState(jobName string) *jobState {
+	loadedStatesMu.Lock()
+	defer loadedStatesMu.Unlock()
+	st := loadedStates[jobName]
+	delete(loadedStates, jobName)
+	return st
+}
+
+// restoreStateLocked restores t from st for the given jc.
+//
+// It must be called under t.mu before applying jc to t.
+func (t *target) restoreStateLocked(st *jobState, jc *jobConfig) {
+	t.labelName = jc.LabelName
+	t.targetAddr = jc.TargetAddr
+	// Extra labels are restored together with targets, so the following update doesn't register them as churn.
+	lt, err := parseLabelTemplates(jc.Labels)
+	if err != nil {
+		log.Fatalf("BUG: label templates must be validated before restoring the target: %s", err)
+	}
+	labelDist, err := parseDistribution(jc.LabelDistribution)
+	if err != nil {
+		log.Fatalf("BUG: label distribution must be validated before restoring the target: %s", err)
+	}
+	t.labelTemplates = lt
+	t.labelDist = labelDist
+	scs := make([]*staticConfig, len(st.Targets))
+	for i, ts := range st.Targets {
+		scs[i] = t.staticConfigLocked(ts.ID, ts.Revision)
+	}
+	t.config = &scrapeConfig{
+		StaticConfigs: scs,
+	}
+	t.restoreTopologyLocked(st.Topology, jc.Topology)
+	t.targetsCount = st.TargetsCount
+	t.rev = st.Revision
+	t.ticks = st.Ticks
+	t.nextID = st.NextID
+	churnEvents.setMinRevision(t.jobName, st.Revision)
+	if !st.StartTime.IsZero() {
+		t.startTime = st.StartTime
+	}
+}
+
+// state returns the current churn state for t.
+func (t *target) state() *jobState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scs := t.config.StaticConfigs
+	tss := make([]targetState, len(scs))
+	for i, sc := range scs {
+		tss[i] = targetState{
+			ID:       sc.id,
+			Revision: sc.rev,
+		}
+	}
+	return &jobState{
+		Revision:     t.rev,
+		Ticks:        t.ticks,
+		NextID:       t.nextID,
+		TargetsCount: t.targetsCount,
+		StartTime:    t.startTime,
+		Targets:      tss,
+		Topology:     t.topologyStateLocked(),
+	}
+}
+
+// flushState writes the current churn state for js to -stateFile.
+func flushState(js *jobs) error {
+	ss := &savedState{
+		RandomSeed: *randomSeed,
+		Jobs:       make(map[string]*jobState),
+	}
+	for _, t := range js.getTargets() {
+		ss.Jobs[t.jobName] = t.state()
+	}
+	data, err := json.Marshal(ss)
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling state: %s", err)
+	}
+	return writeFileAtomic(*stateFile, data)
+}
+
+// runStateFlusher flushes the churn state for js to -stateFile every -stateFlushInterval until stopCh is closed.
+//
+// The final state must be flushed by the caller after runStateFlusher returns.
+func runStateFlusher(js *jobs, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(*stateFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := flushState(js); err != nil {
+				log.Printf("cannot flush state: %s", err)
+			}
+		}
+	}
+}
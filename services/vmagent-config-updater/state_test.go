@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	defer func(v string) {
+		*stateFile = v
+	}(*stateFile)
+	*stateFile = filepath.Join(t.TempDir(), "state.json")
+
+	const config = `
+jobs:
+- job_name: state_job
+  targets_count: 20
+  update_interval: 1m
+  update_percent: 10
+  churn:
+    strategy: storm
+    storm_interval: 3m
+    storm_percent: 100
+    mode: replace
+`
+	js := &jobs{}
+	applyJobsConfig(t, js, config)
+	tg := js.getTarget("state_job")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+	if err := flushState(js); err != nil {
+		t.Fatalf("cannot flush state: %s", err)
+	}
+	h := newRequestHandler(js)
+	wantConfig := serveRequest(h, "/api/v1/config", nil).Body.Bytes()
+	js.update(nil)
+
+	// Restart with the same config.
+	initState()
+	js = &jobs{}
+	applyJobsConfig(t, js, config)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h = newRequestHandler(js)
+	if got := serveRequest(h, "/api/v1/config", nil).Body.Bytes(); !bytes.Equal(got, wantConfig) {
+		t.Fatalf("unexpected config after restoring state\ngot\n%s\nwant\n%s", got, wantConfig)
+	}
+
+	// Applying the same config again mustn't change targets.
+	applyJobsConfig(t, js, config)
+	if got := serveRequest(h, "/api/v1/config", nil).Body.Bytes(); !bytes.Equal(got, wantConfig) {
+		t.Fatalf("unexpected config after config reload\ngot\n%s\nwant\n%s", got, wantConfig)
+	}
+	if n := len(churnEvents.getEvents("state_job", *churnLogSize)); n != 0 {
+		t.Fatalf("restoring state mustn't generate churn events; got %d events", n)
+	}
+	if resp := serveRequest(h, "/api/v1/config/diff?job=state_job&from=5", nil); resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for config diff since the restored revision; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	if resp := serveRequest(h, "/api/v1/config/diff?job=state_job&from=4", nil); resp.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code for config diff before the restored revision; got %d; want %d", resp.Code, http.StatusBadRequest)
+	}
+
+	// The storm cadence continues from the persisted state, so the storm fires at the 6th update.
+	tg = js.getTarget("state_job")
+	now = now.Add(time.Minute)
+	tg.tick(now)
+	if got := countTargetsWithRevision(t, h, "state_job", 6); got != 20 {
+		t.Fatalf("unexpected number of targets updated by storm after restoring state; got %d; want 20", got)
+	}
+}
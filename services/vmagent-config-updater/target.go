@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// target generates scrape config for a single job and periodically updates labels for its targets.
+type target struct {
+	// jobName is the job name for the target. It never changes, so it can be read without locking mu.
+	jobName string
+
+	// seed is used for selecting targets to update at every revision.
+	seed uint64
+
+	// startTime is the job start time. It is used for calculating the number of targets according to load profile.
+	startTime time.Time
+
+	// updateCh is notified when update interval changes or when load profile is set or unset
+	updateCh chan struct{}
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+
+	// fileSDMu serializes writes of file_sd for t, since they are performed from the update loop and from HTTP handlers.
+	fileSDMu sync.Mutex
+
+	mu             sync.Mutex
+	config         *scrapeConfig
+	labelName      string
+	targetAddr     string
+	updatePercent  float64
+	updateInterval time.Duration
+	churn          churnStrategy
+	churnName      string
+	churnMode      string
+	targetsCount   int
+	minTargets     int
+	maxTargets     int
+	rev            int
+	nextID         int
+	prevUpdate     time.Time
+	nextUpdate     time.Time
+	loadProfile    loadProfileConfig
+
+	// ticks is the number of regular updates performed every updateInterval.
+	// Unlike rev, it isn't changed by other updates, so periodic churn strategies keep their cadence.
+	ticks int
+
+	// topo contains pods for jobs with topology config. It is nil for jobs without topology.
+	topo *topology
+
+	// labelTemplates contains templates for extra target labels. It is nil if extra labels aren't configured.
+	labelTemplates *labelTemplates
+
+	// labelDist and churnDist are distributions of targets among label values and of churn among targets. nil means uniform.
+	labelDist *distribution
+	churnDist *distribution
+
+	// version is incremented on every change of the generated config. It is used for caching responses.
+	version      uint64
+	lastModified time.Time
+}
+
+func newTarget(jc *jobConfig) *target {
+	t := &target{
+		jobName:    jc.ScrapeConfig.JobName,
+		seed:       jobSeed(jc.ScrapeConfig.JobName),
+		updateCh:   make(chan struct{}, 1),
+		stopCh:     make(chan struct{}),
+		prevUpdate: time.Now(),
+		startTime:  time.Now(),
+	}
+	churnEvents.resetJob(t.jobName)
+	if st := popLoadedState(t.jobName); st != nil {
+		t.mu.Lock()
+		t.restoreStateLocked(st, jc)
+		t.mu.Unlock()
+	}
+	t.update(jc)
+	return t
+}
+
+func newStaticConfig(targetAddr, labelName string, id, rev int) *staticConfig {
+	return &staticConfig{
+		Targets: []string{targetAddr},
+		Labels: map[string]string{
+			labelName:  fmt.Sprintf("%s-%d", labelName, id),
+			"revision": fmt.Sprintf("r%d", rev),
+		},
+		id:  id,
+		rev: rev,
+	}
+}
+
+// newStaticConfigLocked returns static config for a new target with unique id.
+//
+// It must be called under t.mu.
+func (t *target) newStaticConfigLocked() *staticConfig {
+	sc := t.staticConfigLocked(t.nextID, t.rev)
+	t.nextID++
+	return sc
+}
+
+// staticConfigLocked returns static config for the target with the given id and revision including extra labels.
+//
+// It must be called under t.mu.
+func (t *target) staticConfigLocked(id, rev int) *staticConfig {
+	sc := newStaticConfig(t.targetAddr, t.labelName, id, rev)
+	t.applyLabelTemplatesLocked(sc)
+	return sc
+}
+
+// update applies jc to t.
+//
+// The current revisions of the existing targets are preserved, so the update doesn't generate churn on its own
+// unless it changes target labels. Changed labels are registered as relabeled targets at the next revision,
+// so they are visible at /api/v1/config/diff and at the churn log.
+//
+// jc must be validated before calling update.
+func (t *target) update(jc *jobConfig) {
+	cs, err := newChurnStrategy(&jc.Churn)
+	if err != nil {
+		log.Fatalf("BUG: churn config must be validated before updating the target: %s", err)
+	}
+	t.mu.Lock()
+	var scs []*staticConfig
+	if t.config != nil {
+		scs = t.config.StaticConfigs
+	}
+	lt, err := parseLabelTemplates(jc.Labels)
+	if err != nil {
+		log.Fatalf("BUG: label templates must be validated before updating the target: %s", err)
+	}
+	labelDist, err := parseDistribution(jc.LabelDistribution)
+	if err != nil {
+		log.Fatalf("BUG: label distribution must be validated before updating the target: %s", err)
+	}
+	churnDist, err := parseDistribution(jc.Churn.Distribution)
+	if err != nil {
+		log.Fatalf("BUG: churn distribution must be validated before updating the target: %s", err)
+	}
+	labelsChanged := !t.labelTemplates.equal(jc.Labels)
+	labelDistChanged := labelDist.String() != t.labelDist.String()
+	topologyDisabled := t.topo != nil && !jc.Topology.isSet()
+	regenerate := jc.LabelName != t.labelName || jc.TargetAddr != t.targetAddr || labelsChanged || labelDistChanged || topologyDisabled
+	if topologyDisabled {
+		t.topo = nil
+	}
+	t.labelName = jc.LabelName
+	t.targetAddr = jc.TargetAddr
+	if labelsChanged {
+		t.labelTemplates = lt
+	}
+	t.labelDist = labelDist
+	t.churnDist = churnDist
+	if regenerate && len(scs) > 0 {
+		t.rev++
+		if t.topo != nil {
+			scs = scs[:0]
+			for _, pod := range t.topo.pods {
+				pod.targets = t.topologyPodTargets(pod)
+				scs = append(scs, pod.targets...)
+			}
+		} else {
+			for i, sc := range scs {
+				scs[i] = t.staticConfigLocked(sc.id, sc.rev)
+			}
+		}
+		var cr churnResult
+		for _, sc := range scs {
+			cr.relabeled = append(cr.relabeled, sc.id)
+		}
+		churnEvents.add(t.jobName, t.rev, time.Now(), &cr)
+	}
+	sc := jc.ScrapeConfig
+	sc.StaticConfigs = scs
+	t.config = &sc
+	loadProfileChanged := t.loadProfile.isSet() != jc.LoadProfile.isSet()
+	t.loadProfile = jc.LoadProfile
+	if jc.Topology.isSet() {
+		if t.topo == nil || !t.topo.cfg.sameShape(&jc.Topology) {
+			t.initTopologyLocked(jc.Topology, jc.TargetsCount)
+			t.targetsCount = jc.TargetsCount
+		} else if labelDistChanged {
+			// Move pods among deployments according to the new distribution.
+			t.resizeTopologyLocked(len(t.topo.pods))
+		}
+		t.topo.cfg = jc.Topology
+	}
+	if t.loadProfile.isSet() {
+		t.targetsCount = jc.TargetsCount
+		t.applyLoadProfileLocked(time.Now())
+	} else if jc.TargetsCount != t.targetsCount {
+		// The number of targets may drift from targets_count because of churn.mode=resize,
+		// so the targets are resized only if targets_count changes.
+		t.resizeLocked(jc.TargetsCount)
+		t.targetsCount = jc.TargetsCount
+	}
+	t.updatePercent = *jc.UpdatePercent / 100
+	t.churn = cs
+	t.churnName = jc.Churn.Strategy
+	t.churnMode = jc.Churn.Mode
+	t.minTargets = jc.Churn.MinTargets
+	t.maxTargets = jc.Churn.MaxTargets
+	intervalChanged := t.updateInterval != jc.UpdateInterval
+	t.updateInterval = jc.UpdateInterval
+	t.markModified()
+	t.mu.Unlock()
+
+	if intervalChanged || loadProfileChanged {
+		select {
+		case t.updateCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// start writes the initial file_sd for t and starts periodic updates of t in background.
+func (t *target) start() error {
+	if err := t.writeFileSD(); err != nil {
+		return err
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.run()
+	}()
+	return nil
+}
+
+// stop stops background updates for t and removes its file_sd.
+func (t *target) stop() {
+	close(t.stopCh)
+	t.wg.Wait()
+	if err := t.removeFileSD(); err != nil {
+		log.Printf("cannot remove file_sd for job %q: %s", t.jobName, err)
+	}
+}
+
+// scheduleNextUpdate registers the next update time for t and returns the interval until the next update.
+func (t *target) scheduleNextUpdate() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextUpdate = time.Now().Add(t.updateInterval)
+	return t.updateInterval
+}
+
+func (t *target) hasLoadProfile() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loadProfile.isSet()
+}
+
+func (t *target) run() {
+	ticker := time.NewTicker(t.scheduleNextUpdate())
+	defer ticker.Stop()
+	// loadTicker is started only when load profile is set for t.
+	var loadTicker *time.Ticker
+	var loadTickerCh <-chan time.Time
+	updateLoadTicker := func() {
+		hasLoadProfile := t.hasLoadProfile()
+		if hasLoadProfile && loadTicker == nil {
+			loadTicker = time.NewTicker(*loadProfileCheckInterval)
+			loadTickerCh = loadTicker.C
+		} else if !hasLoadProfile && loadTicker != nil {
+			loadTicker.Stop()
+			loadTicker, loadTickerCh = nil, nil
+		}
+	}
+	updateLoadTicker()
+	defer func() {
+		if loadTicker != nil {
+			loadTicker.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-t.updateCh:
+			ticker.Reset(t.scheduleNextUpdate())
+			updateLoadTicker()
+			continue
+		case <-loadTickerCh:
+			t.mu.Lock()
+			changed := t.applyLoadProfileLocked(time.Now())
+			t.mu.Unlock()
+			if changed {
+				if err := t.writeFileSD(); err != nil {
+					log.Printf("cannot write file_sd for job %q: %s", t.jobName, err)
+				}
+			}
+			continue
+		case <-ticker.C:
+			t.scheduleNextUpdate()
+		}
+		t.tick(time.Now())
+	}
+}
+
+// tick performs the regular update for t at the given time.
+func (t *target) tick(now time.Time) {
+	t.mu.Lock()
+	t.ticks++
+	cr := t.churnLocked(now, t.churn)
+	t.prevUpdate = now
+	t.mu.Unlock()
+	t.finishChurn(cr)
+}
+
+// churnBurst immediately updates the given percent of targets according to t.churnMode.
+func (t *target) churnBurst(percent float64) *churnResult {
+	t.mu.Lock()
+	cr := t.churnLocked(time.Now(), burstChurn{percent: percent / 100})
+	t.mu.Unlock()
+	metrics.getOrCreateCounter(`vmagent_config_updater_churn_bursts_total{job=` + quoteLabelValue(t.jobName) + `}`).inc()
+	t.finishChurn(cr)
+	return cr
+}
+
+// finishChurn registers metrics for cr and writes the updated file_sd for t.
+func (t *target) finishChurn(cr *churnResult) {
+	metrics.getOrCreateCounter(`vmagent_config_updater_updates_total{job=` + quoteLabelValue(t.jobName) + `}`).inc()
+	metrics.getOrCreateCounter(`vmagent_config_updater_relabeled_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.relabeled))
+	metrics.getOrCreateCounter(`vmagent_config_updater_added_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.added))
+	metrics.getOrCreateCounter(`vmagent_config_updater_removed_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.removed))
+	if err := t.writeFileSD(); err != nil {
+		log.Printf("cannot write file_sd for job %q: %s", t.jobName, err)
+	}
+}
+
+// resizeLocked adds new targets or removes the most recently added targets, so t contains n targets.
+//
+// The revision is incremented if the existing targets are changed, so the change can be tracked via /api/v1/config/diff.
+// It returns true if the number of targets has been changed. It must be called under t.mu.
+func (t *target) resizeLocked(n int) bool {
+	if t.topo != nil {
+		return t.resizeTopologyLocked(n)
+	}
+	scs := t.config.StaticConfigs
+	if len(scs) == n {
+		return false
+	}
+	if len(scs) > 0 {
+		t.rev++
+	}
+	var cr churnResult
+	if len(scs) > n {
+		cr.removed = append(cr.removed, scs[n:]...)
+		metrics.getOrCreateCounter(`vmagent_config_updater_removed_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(scs) - n)
+		clear(scs[n:])
+		scs = scs[:n]
+	} else {
+		metrics.getOrCreateCounter(`vmagent_config_updater_added_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(n - len(scs))
+		for len(scs) < n {
+			sc := t.newStaticConfigLocked()
+			cr.added = append(cr.added, sc.id)
+			scs = append(scs, sc)
+		}
+	}
+	t.config.StaticConfigs = scs
+	churnEvents.add(t.jobName, t.rev, time.Now(), &cr)
+	t.markModified()
+	return true
+}
+
+// applyLoadProfileLocked sets the number of targets according to t.loadProfile at the given time.
+//
+// It returns true if the number of targets has been changed. It must be called under t.mu.
+func (t *target) applyLoadProfileLocked(now time.Time) bool {
+	if !t.loadProfile.isSet() {
+		return false
+	}
+	return t.resizeLocked(t.loadProfile.targetsAt(t.targetsCount, now.Sub(t.startTime)))
+}
+
+// churnResult contains targets changed by a single churn update.
+type churnResult struct {
+	// relabeled and added contain ids for the relabeled and the added targets.
+	relabeled []int
+	added     []int
+
+	removed []*staticConfig
+}
+
+// churnLocked increments the revision for t and applies t.churnMode to the targets selected by cs.
+//
+// It must be called under t.mu.
+func (t *target) churnLocked(now time.Time, cs churnStrategy) *churnResult {
+	t.rev++
+	if t.topo != nil {
+		return t.churnTopologyLocked(now, cs)
+	}
+	scs := t.config.StaticConfigs
+	targetRevs := make([]int, len(scs))
+	for i, sc := range scs {
+		targetRevs[i] = sc.rev
+	}
+	cc := &churnContext{
+		seed:           t.seed,
+		rev:            t.rev,
+		tick:           t.ticks,
+		targetRevs:     targetRevs,
+		weights:        t.churnDist.weights(len(targetRevs)),
+		updatePercent:  t.updatePercent,
+		updateInterval: t.updateInterval,
+		prevUpdate:     t.prevUpdate,
+		now:            now,
+	}
+	idxs := cs.selectTargets(cc)
+	var cr churnResult
+	switch t.churnMode {
+	case "replace":
+		for _, idx := range idxs {
+			cr.removed = append(cr.removed, scs[idx])
+			scs[idx] = t.newStaticConfigLocked()
+			cr.added = append(cr.added, scs[idx].id)
+		}
+	case "resize":
+		for _, idx := range idxs {
+			cr.removed = append(cr.removed, scs[idx])
+		}
+		scs = removeStaticConfigs(scs, idxs)
+		// Add up to twice the number of removed targets, so the number of targets fluctuates around its current value.
+		// Additionally, return a tenth of the deviation from targets_count, so the number of targets doesn't drift away
+		// and recovers after dropping to zero, when no targets can be selected for update.
+		n := int(randFloat64(t.seed, t.rev, -1) * float64(2*len(idxs)+1))
+		n += int(math.Round(float64(t.targetsCount-len(scs)-len(idxs)) * resizeReversion))
+		n = min(max(len(scs)+n, t.minTargets), t.maxTargets) - len(scs)
+		for i := 0; i < n; i++ {
+			sc := t.newStaticConfigLocked()
+			cr.added = append(cr.added, sc.id)
+			scs = append(scs, sc)
+		}
+		t.config.StaticConfigs = scs
+	default:
+		revStr := fmt.Sprintf("r%d", t.rev)
+		for _, idx := range idxs {
+			scs[idx].Labels["revision"] = revStr
+			scs[idx].rev = t.rev
+			t.applyLabelTemplatesLocked(scs[idx])
+			cr.relabeled = append(cr.relabeled, scs[idx].id)
+		}
+	}
+	churnEvents.add(t.jobName, t.rev, now, &cr)
+	t.markModified()
+	return &cr
+}
+
+// resizeReversion is the share of the deviation from targets_count, which is returned at every update in `resize` churn mode.
+const resizeReversion = 0.1
+
+// removeStaticConfigs removes static configs with the given idxs from scs.
+func removeStaticConfigs(scs []*staticConfig, idxs []int) []*staticConfig {
+	removed := make(map[int]struct{}, len(idxs))
+	for _, idx := range idxs {
+		removed[idx] = struct{}{}
+	}
+	result := scs[:0]
+	for i, sc := range scs {
+		if _, ok := removed[i]; !ok {
+			result = append(result, sc)
+		}
+	}
+	clear(scs[len(result):])
+	return result
+}
+
+// markModified must be called under t.mu after every change of t.config.
+func (t *target) markModified() {
+	t.version++
+	t.lastModified = time.Now()
+}
+
+// getVersion returns the version and the last modification time for the config generated by t.
+func (t *target) getVersion() (uint64, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version, t.lastModified
+}
+
+// jobStatus is returned from /api/v1/jobs for every job.
+type jobStatus struct {
+	JobName        string    `json:"job_name"`
+	Revision       int       `json:"revision"`
+	TargetsCount   int       `json:"targets_count"`
+	ScrapeInterval string    `json:"scrape_interval"`
+	UpdateInterval string    `json:"update_interval"`
+	UpdatePercent  float64   `json:"update_percent"`
+	ChurnStrategy  string    `json:"churn_strategy"`
+	NextUpdate     time.Time `json:"next_update"`
+}
+
+func (t *target) status() *jobStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &jobStatus{
+		JobName:        t.jobName,
+		Revision:       t.rev,
+		TargetsCount:   len(t.config.StaticConfigs),
+		ScrapeInterval: t.config.ScrapeInterval.String(),
+		UpdateInterval: t.updateInterval.String(),
+		UpdatePercent:  t.updatePercent * 100,
+		ChurnStrategy:  t.churnName,
+		NextUpdate:     t.nextUpdate,
+	}
+}
+
+// marshal returns scrape config for t with targets belonging to ss. The version of t is registered at rk.
+func (t *target) marshal(ss shardSpec, rk *renderKey) *yaml.Node {
+	n := &yaml.Node{}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rk.addLocked(t)
+	sc := *t.config
+	sc.StaticConfigs = ss.filter(sc.StaticConfigs)
+	if err := n.Encode(&sc); err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling scrape config: %s", err)
+	}
+	return n
+}
+
+// prometheusConfig returns a copy of Prometheus-compatible scrape config for t with targets belonging to ss.
+//
+// The returned config can be used without holding t.mu. The version of t is registered at rk.
+func (t *target) prometheusConfig(ss shardSpec, rk *renderKey) (*scrapeConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rk.addLocked(t)
+	sc, err := t.config.prometheusCompatible()
+	if err != nil {
+		return nil, err
+	}
+	scs := ss.filter(sc.StaticConfigs)
+	sc.StaticConfigs = make([]*staticConfig, len(scs))
+	for i, s := range scs {
+		sc.StaticConfigs[i] = cloneStaticConfig(s)
+	}
+	return sc, nil
+}
+
+// marshalPrometheus returns Prometheus-compatible scrape config for t with targets belonging to ss.
+func (t *target) marshalPrometheus(ss shardSpec, rk *renderKey) (*yaml.Node, error) {
+	sc, err := t.prometheusConfig(ss, rk)
+	if err != nil {
+		return nil, err
+	}
+	n := &yaml.Node{}
+	if err := n.Encode(sc); err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling scrape config: %s", err)
+	}
+	return n, nil
+}
+
+// marshalSD returns target groups belonging to ss for t in the format expected by Prometheus http_sd_configs.
+//
+// The version of t is registered at rk if it isn't nil.
+//
+// See https://prometheus.io/docs/prometheus/latest/http_sd/
+func (t *target) marshalSD(ss shardSpec, rk *renderKey) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rk.addLocked(t)
+	data, err := json.Marshal(ss.filter(t.config.StaticConfigs))
+	if err != nil {
+		log.Fatalf("BUG: unexpected error when marshaling http_sd target groups: %s", err)
+	}
+	return data
+}
+
+// staticConfigs returns a copy of static configs for all the targets of t.
+//
+// The returned configs can be used without holding t.mu.
+func (t *target) staticConfigs() []*staticConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scs := make([]*staticConfig, len(t.config.StaticConfigs))
+	for i, sc := range t.config.StaticConfigs {
+		scs[i] = cloneStaticConfig(sc)
+	}
+	return scs
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+var (
+	topologyNamespaces = newArrayFlag("topologyNamespaces", 0, "The number of Kubernetes namespaces for modeling Kubernetes topology. "+
+		"If it is set, then targets are generated as containers of pods belonging to deployments, while churn is generated by rolling updates, "+
+		"container restarts and node drains. -targetsCount sets the number of pods in this case. "+
+		"See https://github.com/VictoriaMetrics/prometheus-benchmark/tree/main/services/vmagent-config-updater#kubernetes-topology")
+	topologyDeployments         = newArrayFlag("topologyDeployments", 5, "The number of deployments per namespace for -topologyNamespaces")
+	topologyNodes               = newArrayFlag("topologyNodes", 10, "The number of nodes for -topologyNamespaces")
+	topologyContainers          = newArrayFlag("topologyContainers", 1, "The number of containers per pod for -topologyNamespaces. Every container is a separate target")
+	topologyRolloutInterval     = newArrayFlag("topologyRolloutInterval", time.Duration(0), "Mean interval between rolling updates for every deployment for -topologyNamespaces. Rolling updates are disabled if it is zero")
+	topologyRolloutBatchPercent = newArrayFlag("topologyRolloutBatchPercent", 25.0, "The percent of deployment pods replaced every -scrapeConfigUpdateInterval during rolling updates for -topologyNamespaces")
+	topologyCrashLoopPercent    = newArrayFlag("topologyCrashLoopPercent", 0.0, "The percent of pods in CrashLoopBackOff state for -topologyNamespaces. "+
+		"Containers of such pods are restarted with exponential backoff from 10s up to 5m")
+	topologyDrainInterval = newArrayFlag("topologyDrainInterval", time.Duration(0), "Mean interval between node drains for -topologyNamespaces. Node drains are disabled if it is zero")
+)
+
+// topologyConfig describes Kubernetes topology for generating targets and churn.
+type topologyConfig struct {
+	Namespaces          int           `yaml:"namespaces,omitempty"`
+	Deployments         int           `yaml:"deployments_per_namespace,omitempty"`
+	Nodes               int           `yaml:"nodes,omitempty"`
+	Containers          int           `yaml:"containers_per_pod,omitempty"`
+	RolloutInterval     time.Duration `yaml:"rollout_interval,omitempty"`
+	RolloutBatchPercent float64       `yaml:"rollout_batch_percent,omitempty"`
+	CrashLoopPercent    float64       `yaml:"crash_loop_percent,omitempty"`
+	DrainInterval       time.Duration `yaml:"drain_interval,omitempty"`
+}
+
+// topologyConfigFromFlags returns topologyConfig from command-line flags for the job with the given idx.
+func topologyConfigFromFlags(idx int) topologyConfig {
+	return topologyConfig{
+		Namespaces:          topologyNamespaces.getArg(idx),
+		Deployments:         topologyDeployments.getArg(idx),
+		Nodes:               topologyNodes.getArg(idx),
+		Containers:          topologyContainers.getArg(idx),
+		RolloutInterval:     topologyRolloutInterval.getArg(idx),
+		RolloutBatchPercent: topologyRolloutBatchPercent.getArg(idx),
+		CrashLoopPercent:    topologyCrashLoopPercent.getArg(idx),
+		DrainInterval:       topologyDrainInterval.getArg(idx),
+	}
+}
+
+func (tc *topologyConfig) isSet() bool {
+	return tc.Namespaces > 0
+}
+
+// setDefaults sets default values from command-line flags for missing options at tc.
+func (tc *topologyConfig) setDefaults() {
+	if !tc.isSet() {
+		return
+	}
+	if tc.Deployments == 0 {
+		tc.Deployments = topologyDeployments.defaultValue
+	}
+	if tc.Nodes == 0 {
+		tc.Nodes = topologyNodes.defaultValue
+	}
+	if tc.Containers == 0 {
+		tc.Containers = topologyContainers.defaultValue
+	}
+	if tc.RolloutBatchPercent == 0 {
+		tc.RolloutBatchPercent = topologyRolloutBatchPercent.defaultValue
+	}
+}
+
+func (tc *topologyConfig) validate() error {
+	if tc.Namespaces < 0 {
+		return fmt.Errorf("`namespaces` cannot be negative; got %d", tc.Namespaces)
+	}
+	if !tc.isSet() {
+		return nil
+	}
+	if tc.Deployments <= 0 {
+		return fmt.Errorf("`deployments_per_namespace` must be positive; got %d", tc.Deployments)
+	}
+	if tc.Nodes <= 0 {
+		return fmt.Errorf("`nodes` must be positive; got %d", tc.Nodes)
+	}
+	if tc.Containers <= 0 {
+		return fmt.Errorf("`containers_per_pod` must be positive; got %d", tc.Containers)
+	}
+	if tc.RolloutInterval < 0 {
+		return fmt.Errorf("`rollout_interval` cannot be negative; got %s", tc.RolloutInterval)
+	}
+	if tc.RolloutBatchPercent <= 0 || tc.RolloutBatchPercent > 100 {
+		return fmt.Errorf("`rollout_batch_percent` must be in the range (0..100]; got %v", tc.RolloutBatchPercent)
+	}
+	if err := validatePercent("crash_loop_percent", tc.CrashLoopPercent); err != nil {
+		return err
+	}
+	if tc.DrainInterval < 0 {
+		return fmt.Errorf("`drain_interval` cannot be negative; got %s", tc.DrainInterval)
+	}
+	return nil
+}
+
+// deploymentsCount returns the total number of deployments across all the namespaces.
+func (tc *topologyConfig) deploymentsCount() int {
+	return tc.Namespaces * tc.Deployments
+}
+
+// sameShape returns true if pods generated for tc can be reused for other.
+func (tc *topologyConfig) sameShape(other *topologyConfig) bool {
+	return tc.Namespaces == other.Namespaces && tc.Deployments == other.Deployments &&
+		tc.Nodes == other.Nodes && tc.Containers == other.Containers
+}
+
+var (
+	topologyNamespaceNames = []string{"default", "kube-system", "monitoring", "ingress-nginx", "payments", "checkout", "search", "auth", "billing", "analytics"}
+	topologyAppNames       = []string{"api", "web", "worker", "gateway", "cache", "scheduler", "consumer", "frontend", "backend", "indexer"}
+	topologyContainerNames = []string{"app", "istio-proxy", "log-shipper", "config-reloader"}
+)
+
+// topologyName returns the name with the given index from names. Numeric suffix is added to names exceeding the list.
+func topologyName(names []string, i int) string {
+	if i < len(names) {
+		return names[i]
+	}
+	return fmt.Sprintf("%s-%d", names[i%len(names)], i/len(names))
+}
+
+// topologyAlphabet is the alphabet used by Kubernetes for generated names. It doesn't contain vowels and confusing chars.
+const topologyAlphabet = "bcdfghjklmnpqrstvwxz2456789"
+
+// topologyRandString returns pseudo-random string with n chars from topologyAlphabet for x.
+func topologyRandString(x uint64, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = topologyAlphabet[x%uint64(len(topologyAlphabet))]
+		x /= uint64(len(topologyAlphabet))
+	}
+	return string(b)
+}
+
+// topology holds pods generated for the job according to topologyConfig.
+type topology struct {
+	cfg topologyConfig
+
+	// generations contains the current pod template generation per deployment.
+	generations []int
+
+	pods []*topologyPod
+}
+
+// topologyPod is a single pod with its containers.
+//
+// Containers are represented by targets with consecutive ids starting from ID.
+type topologyPod struct {
+	ID          int  `json:"id"`
+	Deployment  int  `json:"deployment"`
+	Node        int  `json:"node"`
+	Generation  int  `json:"generation"`
+	Revision    int  `json:"revision"`
+	Restarts    int  `json:"restarts"`
+	CrashLoop   bool `json:"crash_loop,omitempty"`
+	NextRestart int  `json:"next_restart,omitempty"`
+
+	targets []*staticConfig
+}
+
+// topologyState is the persisted state for topology.
+type topologyState struct {
+	Generations []int          `json:"generations"`
+	Pods        []*topologyPod `json:"pods"`
+}
+
+// topologyLabelNames contains labels set by topologyPodTargets. They cannot be overridden by label templates.
+var topologyLabelNames = []string{"namespace", "node", "app", "pod", "pod_template_hash", "container", "container_id"}
+
+// topologyPodTargets returns targets for containers of the given pod.
+//
+// It must be called under t.mu.
+func (t *target) topologyPodTargets(pod *topologyPod) []*staticConfig {
+	cfg := &t.topo.cfg
+	d := pod.Deployment
+	namespace := topologyName(topologyNamespaceNames, d/cfg.Deployments)
+	app := topologyName(topologyAppNames, d%cfg.Deployments)
+	hash := topologyRandString(randUint64(t.seed, pod.Generation, -d-1), 10)
+	podName := fmt.Sprintf("%s-%s-%s", app, hash, topologyRandString(randUint64(t.seed, -1, pod.ID), 5))
+	scs := make([]*staticConfig, cfg.Containers)
+	for i := range scs {
+		id := pod.ID + i
+		scs[i] = &staticConfig{
+			Targets: []string{t.targetAddr},
+			Labels: map[string]string{
+				"namespace":         namespace,
+				"node":              fmt.Sprintf("node-%d", pod.Node),
+				"app":               app,
+				"pod":               podName,
+				"pod_template_hash": hash,
+				"container":         topologyName(topologyContainerNames, i),
+				"container_id":      fmt.Sprintf("%012x", randUint64(t.seed, pod.Restarts, id)>>16),
+			},
+			id:  id,
+			rev: pod.Revision,
+		}
+		t.applyLabelTemplatesLocked(scs[i])
+	}
+	return scs
+}
+
+// newTopologyPodLocked returns new pod for the deployment d with the current pod template generation.
+//
+// The pod is scheduled to a pseudo-random node other than excludeNode. It must be called under t.mu.
+func (t *target) newTopologyPodLocked(d, excludeNode int) *topologyPod {
+	cfg := &t.topo.cfg
+	pod := &topologyPod{
+		ID:          t.nextID,
+		Deployment:  d,
+		Generation:  t.topo.generations[d],
+		Revision:    t.rev,
+		CrashLoop:   randFloat64(t.seed, -3, t.nextID) < cfg.CrashLoopPercent/100,
+		NextRestart: t.rev + 1,
+	}
+	t.nextID += cfg.Containers
+	nodes := cfg.Nodes
+	if excludeNode >= 0 && nodes > 1 {
+		nodes--
+	}
+	pod.Node = int(randFloat64(t.seed, -2, pod.ID) * float64(nodes))
+	if excludeNode >= 0 && cfg.Nodes > 1 && pod.Node >= excludeNode {
+		pod.Node++
+	}
+	pod.targets = t.topologyPodTargets(pod)
+	return pod
+}
+
+// initTopologyLocked replaces all the targets of t with pods generated according to cfg.
+//
+// It must be called under t.mu.
+func (t *target) initTopologyLocked(cfg topologyConfig, podsCount int) {
+	scs := t.config.StaticConfigs
+	if len(scs) > 0 {
+		t.rev++
+	}
+	cr := &churnResult{
+		removed: scs,
+	}
+	t.topo = &topology{
+		cfg:         cfg,
+		generations: make([]int, cfg.deploymentsCount()),
+	}
+	t.scaleTopologyLocked(podsCount, cr)
+	t.finishTopologyChurnLocked(time.Now(), cr)
+	t.registerResizeMetrics(cr)
+}
+
+// restoreTopologyLocked restores topology for t from ts if ts matches cfg.
+//
+// It must be called under t.mu.
+func (t *target) restoreTopologyLocked(ts *topologyState, cfg topologyConfig) bool {
+	if ts == nil || !cfg.isSet() || len(ts.Generations) != cfg.deploymentsCount() {
+		return false
+	}
+	for _, pod := range ts.Pods {
+		if pod.Deployment < 0 || pod.Deployment >= len(ts.Generations) || pod.Node < 0 || pod.Node >= cfg.Nodes {
+			return false
+		}
+	}
+	t.topo = &topology{
+		cfg:         cfg,
+		generations: ts.Generations,
+		pods:        ts.Pods,
+	}
+	var scs []*staticConfig
+	for _, pod := range t.topo.pods {
+		pod.targets = t.topologyPodTargets(pod)
+		scs = append(scs, pod.targets...)
+	}
+	t.config.StaticConfigs = scs
+	return true
+}
+
+// topologyStateLocked returns a copy of topology state for t. It must be called under t.mu.
+func (t *target) topologyStateLocked() *topologyState {
+	if t.topo == nil {
+		return nil
+	}
+	ts := &topologyState{
+		Generations: append([]int{}, t.topo.generations...),
+		Pods:        make([]*topologyPod, len(t.topo.pods)),
+	}
+	for i, pod := range t.topo.pods {
+		p := *pod
+		p.targets = nil
+		ts.Pods[i] = &p
+	}
+	return ts
+}
+
+// resizeTopologyLocked sets the number of pods to n. It is used instead of resizeLocked for jobs with topology.
+//
+// Pods are also moved among deployments if their replicas don't match t.labelDist.
+// It returns true if pods have been changed. It must be called under t.mu.
+func (t *target) resizeTopologyLocked(n int) bool {
+	replicas, desired := t.topologyReplicasLocked(n)
+	if slices.Equal(replicas, desired) {
+		return false
+	}
+	if len(t.topo.pods) > 0 {
+		t.rev++
+	}
+	var cr churnResult
+	t.scaleTopologyLocked(n, &cr)
+	t.finishTopologyChurnLocked(time.Now(), &cr)
+	t.registerResizeMetrics(&cr)
+	return true
+}
+
+// registerResizeMetrics registers the number of targets added and removed by cr outside churn updates.
+func (t *target) registerResizeMetrics(cr *churnResult) {
+	metrics.getOrCreateCounter(`vmagent_config_updater_added_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.added))
+	metrics.getOrCreateCounter(`vmagent_config_updater_removed_targets_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.removed))
+}
+
+// topologyReplicasLocked returns the current number of replicas per deployment
+// and the desired number of replicas per deployment for n pods spread according to t.labelDist.
+//
+// It must be called under t.mu.
+func (t *target) topologyReplicasLocked(n int) ([]int, []int) {
+	dn := len(t.topo.generations)
+	replicas := make([]int, dn)
+	for _, pod := range t.topo.pods {
+		replicas[pod.Deployment]++
+	}
+	return replicas, split(n, t.labelDist.weights(dn), dn)
+}
+
+// scaleTopologyLocked spreads n pods among deployments according to t.labelDist
+// by adding new pods and removing the most recently added pods.
+//
+// It must be called under t.mu.
+func (t *target) scaleTopologyLocked(n int, cr *churnResult) {
+	tp := t.topo
+	replicas, desired := t.topologyReplicasLocked(n)
+	pods := tp.pods[:0]
+	for i := len(tp.pods) - 1; i >= 0; i-- {
+		// Remove the most recently added pods, which are located at the end of tp.pods.
+		pod := tp.pods[i]
+		if replicas[pod.Deployment] > desired[pod.Deployment] {
+			replicas[pod.Deployment]--
+			cr.removed = append(cr.removed, pod.targets...)
+			tp.pods[i] = nil
+		}
+	}
+	for _, pod := range tp.pods {
+		if pod != nil {
+			pods = append(pods, pod)
+		}
+	}
+	clear(tp.pods[len(pods):])
+	for d := range desired {
+		for replicas[d] < desired[d] {
+			pod := t.newTopologyPodLocked(d, -1)
+			pods = append(pods, pod)
+			replicas[d]++
+			for _, sc := range pod.targets {
+				cr.added = append(cr.added, sc.id)
+			}
+		}
+	}
+	tp.pods = pods
+}
+
+// churnTopologyLocked generates churn for jobs with topology at the current revision.
+//
+// The churn consists of rolling updates, node drains and container restarts. Pods for container restarts
+// are selected by cs in addition to pods in CrashLoopBackOff state. It must be called under t.mu after incrementing t.rev.
+func (t *target) churnTopologyLocked(now time.Time, cs churnStrategy) *churnResult {
+	tp := t.topo
+	cfg := &tp.cfg
+	var cr churnResult
+	replace := func(i, excludeNode int) {
+		pod := tp.pods[i]
+		cr.removed = append(cr.removed, pod.targets...)
+		newPod := t.newTopologyPodLocked(pod.Deployment, excludeNode)
+		for _, sc := range newPod.targets {
+			cr.added = append(cr.added, sc.id)
+		}
+		tp.pods[i] = newPod
+	}
+
+	// Rolling updates replace up to rollout_batch_percent of old pods per deployment at every revision.
+	if cfg.RolloutInterval > 0 {
+		startProbability := float64(t.updateInterval) / float64(cfg.RolloutInterval)
+		replicas := make([]int, len(tp.generations))
+		oldPods := make([][]int, len(tp.generations))
+		for i, pod := range tp.pods {
+			replicas[pod.Deployment]++
+			if pod.Generation < tp.generations[pod.Deployment] {
+				oldPods[pod.Deployment] = append(oldPods[pod.Deployment], i)
+			}
+		}
+		for d := range tp.generations {
+			if len(oldPods[d]) == 0 {
+				if replicas[d] == 0 || randFloat64(t.seed, t.rev, -d-10) >= startProbability {
+					continue
+				}
+				tp.generations[d]++
+				oldPods[d] = make([]int, 0, replicas[d])
+				for i, pod := range tp.pods {
+					if pod.Deployment == d {
+						oldPods[d] = append(oldPods[d], i)
+					}
+				}
+				metrics.getOrCreateCounter(`vmagent_config_updater_topology_rollouts_total{job=` + quoteLabelValue(t.jobName) + `}`).inc()
+			}
+			batch := int(math.Ceil(float64(replicas[d]) * cfg.RolloutBatchPercent / 100))
+			for _, i := range oldPods[d][:min(batch, len(oldPods[d]))] {
+				replace(i, -1)
+			}
+		}
+	}
+
+	// Node drains evict all the pods from a random node. Evicted pods are re-created on other nodes.
+	if cfg.DrainInterval > 0 && randFloat64(t.seed, t.rev, -4) < float64(t.updateInterval)/float64(cfg.DrainInterval) {
+		node := int(randFloat64(t.seed, t.rev, -5) * float64(cfg.Nodes))
+		for i, pod := range tp.pods {
+			if pod.Node == node {
+				replace(i, node)
+			}
+		}
+		metrics.getOrCreateCounter(`vmagent_config_updater_topology_node_drains_total{job=` + quoteLabelValue(t.jobName) + `}`).inc()
+	}
+
+	// Container restarts change container_id label for all the containers of the restarted pod.
+	podRevs := make([]int, len(tp.pods))
+	for i, pod := range tp.pods {
+		podRevs[i] = pod.Revision
+	}
+	restarts := make(map[int]struct{})
+	for _, i := range cs.selectTargets(&churnContext{
+		seed:           t.seed,
+		rev:            t.rev,
+		tick:           t.ticks,
+		targetRevs:     podRevs,
+		weights:        t.churnDist.weights(len(podRevs)),
+		updatePercent:  t.updatePercent,
+		updateInterval: t.updateInterval,
+		prevUpdate:     t.prevUpdate,
+		now:            now,
+	}) {
+		restarts[i] = struct{}{}
+	}
+	for i, pod := range tp.pods {
+		if pod.CrashLoop && pod.NextRestart <= t.rev {
+			restarts[i] = struct{}{}
+		}
+	}
+	for i, pod := range tp.pods {
+		if _, ok := restarts[i]; !ok || pod.Revision == t.rev {
+			// The pod isn't selected for restart or it has been just created.
+			continue
+		}
+		pod.Restarts++
+		pod.Revision = t.rev
+		if pod.CrashLoop {
+			// Kubelet restarts crashed containers with exponential backoff from 10s up to 5m.
+			backoff := min(10*time.Second<<min(pod.Restarts-1, 5), 5*time.Minute)
+			pod.NextRestart = t.rev + max(1, int(math.Ceil(float64(backoff)/float64(t.updateInterval))))
+		}
+		pod.targets = t.topologyPodTargets(pod)
+		for _, sc := range pod.targets {
+			cr.relabeled = append(cr.relabeled, sc.id)
+		}
+	}
+	metrics.getOrCreateCounter(`vmagent_config_updater_topology_pod_restarts_total{job=` + quoteLabelValue(t.jobName) + `}`).add(len(cr.relabeled) / cfg.Containers)
+	t.finishTopologyChurnLocked(now, &cr)
+	return &cr
+}
+
+// finishTopologyChurnLocked updates targets for t from pods and registers cr at the churn log.
+//
+// It must be called under t.mu.
+func (t *target) finishTopologyChurnLocked(now time.Time, cr *churnResult) {
+	scs := make([]*staticConfig, 0, len(t.topo.pods)*t.topo.cfg.Containers)
+	for _, pod := range t.topo.pods {
+		scs = append(scs, pod.targets...)
+	}
+	t.config.StaticConfigs = scs
+	churnEvents.add(t.jobName, t.rev, now, cr)
+	t.markModified()
+}
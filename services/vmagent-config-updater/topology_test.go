@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTopologyRollout(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: topology_rollout
+  targets_count: 12
+  update_interval: 1m
+  update_percent: 0
+  topology:
+    namespaces: 2
+    deployments_per_namespace: 3
+    nodes: 4
+    containers_per_pod: 2
+    rollout_interval: 1m
+    rollout_batch_percent: 50
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	initialPods := getTopologyPods(t, h, "topology_rollout", 6, 2, 2)
+
+	// Every deployment starts rolling update at the first update, which replaces a pod per update.
+	tg := js.getTarget("topology_rollout")
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+		pods := getTopologyPods(t, h, "topology_rollout", 6, 2, 2)
+		replaced := 0
+		for pod := range initialPods {
+			if _, ok := pods[pod]; !ok {
+				replaced++
+			}
+		}
+		if want := 6 * (i + 1); replaced != want {
+			t.Fatalf("unexpected number of pods replaced after %d updates; got %d; want %d", i+1, replaced, want)
+		}
+	}
+}
+
+func TestTopologyNodeDrain(t *testing.T) {
+	js := &jobs{}
+	applyJobsConfig(t, js, `
+jobs:
+- job_name: topology_drain
+  targets_count: 40
+  update_interval: 1m
+  update_percent: 0
+  topology:
+    namespaces: 2
+    deployments_per_namespace: 2
+    nodes: 4
+    containers_per_pod: 2
+    drain_interval: 1m
+`)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h := newRequestHandler(js)
+	pods := getTopologyPods(t, h, "topology_drain", 4, 10, 2)
+
+	tg := js.getTarget("topology_drain")
+	now := time.Now()
+	drains := 0
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+		newPods := getTopologyPods(t, h, "topology_drain", 4, 10, 2)
+
+		// All the evicted pods must belong to a single node, while the new pods must be scheduled to other nodes.
+		drainedNode := ""
+		for pod, node := range pods {
+			if _, ok := newPods[pod]; ok {
+				continue
+			}
+			if len(drainedNode) > 0 && node != drainedNode {
+				t.Fatalf("pods are evicted from multiple nodes %s and %s", drainedNode, node)
+			}
+			drainedNode = node
+		}
+		if len(drainedNode) > 0 {
+			drains++
+		}
+		for pod, node := range newPods {
+			if _, ok := pods[pod]; ok {
+				continue
+			}
+			if node == drainedNode {
+				t.Fatalf("pod %s is re-created on the drained node %s", pod, node)
+			}
+		}
+		pods = newPods
+	}
+	if drains == 0 {
+		t.Fatalf("no pods evicted by node drains")
+	}
+}
+
+func TestTopologyStateRoundTrip(t *testing.T) {
+	defer func(v string) {
+		*stateFile = v
+	}(*stateFile)
+	*stateFile = filepath.Join(t.TempDir(), "state.json")
+
+	const config = `
+jobs:
+- job_name: topology_state
+  targets_count: 20
+  update_interval: 1m
+  update_percent: 10
+  topology:
+    namespaces: 2
+    deployments_per_namespace: 2
+    nodes: 3
+    containers_per_pod: 2
+    rollout_interval: 2m
+    crash_loop_percent: 20
+    drain_interval: 3m
+`
+	js := &jobs{}
+	applyJobsConfig(t, js, config)
+	tg := js.getTarget("topology_state")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		tg.tick(now)
+	}
+	if err := flushState(js); err != nil {
+		t.Fatalf("cannot flush state: %s", err)
+	}
+	h := newRequestHandler(js)
+	wantConfig := serveRequest(h, "/api/v1/config", nil).Body.Bytes()
+	js.update(nil)
+
+	// Restart with the same config.
+	initState()
+	js = &jobs{}
+	applyJobsConfig(t, js, config)
+	t.Cleanup(func() {
+		js.update(nil)
+	})
+	h = newRequestHandler(js)
+	if got := serveRequest(h, "/api/v1/config", nil).Body.Bytes(); !bytes.Equal(got, wantConfig) {
+		t.Fatalf("unexpected config after restoring state\ngot\n%s\nwant\n%s", got, wantConfig)
+	}
+	if n := len(churnEvents.getEvents("topology_state", *churnLogSize)); n != 0 {
+		t.Fatalf("restoring state mustn't generate churn events; got %d events", n)
+	}
+
+	// Restored pods keep evolving with the same number of pods per deployment.
+	tg = js.getTarget("topology_state")
+	now = now.Add(time.Minute)
+	tg.tick(now)
+	getTopologyPods(t, h, "topology_state", 4, 5, 2)
+}
+
+// getTopologyPods returns nodes per pod for the given job served by h.
+//
+// It verifies that every deployment has the given number of pods and every pod has the given number of containers.
+func getTopologyPods(t *testing.T, h http.Handler, job string, deploymentsCount, replicas, containers int) map[string]string {
+	t.Helper()
+	resp := serveRequest(h, "/api/v1/sd/"+job, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for http_sd response; got %d; want %d", resp.Code, http.StatusOK)
+	}
+	var scs []*staticConfig
+	if err := json.Unmarshal(resp.Body.Bytes(), &scs); err != nil {
+		t.Fatalf("cannot parse http_sd response: %s", err)
+	}
+	podContainers := make(map[string]int)
+	pods := make(map[string]string)
+	deployments := make(map[string]map[string]struct{})
+	for _, sc := range scs {
+		pod := sc.Labels["namespace"] + "/" + sc.Labels["pod"]
+		podContainers[pod]++
+		pods[pod] = sc.Labels["node"]
+		d := sc.Labels["namespace"] + "/" + sc.Labels["app"]
+		if deployments[d] == nil {
+			deployments[d] = make(map[string]struct{})
+		}
+		deployments[d][pod] = struct{}{}
+	}
+	if len(deployments) != deploymentsCount {
+		t.Fatalf("unexpected number of deployments; got %d; want %d", len(deployments), deploymentsCount)
+	}
+	for d, dPods := range deployments {
+		if len(dPods) != replicas {
+			t.Fatalf("unexpected number of pods for deployment %s; got %d; want %d", d, len(dPods), replicas)
+		}
+	}
+	for pod, n := range podContainers {
+		if n != containers {
+			t.Fatalf("unexpected number of containers for pod %s; got %d; want %d", pod, n, containers)
+		}
+	}
+	return pods
+}